@@ -1,4 +1,4 @@
-module main
+module applemusic-downloader
 
 go 1.17
 
@@ -6,6 +6,7 @@ require (
 	github.com/abema/go-mp4 v0.7.2
 	github.com/gin-gonic/gin v1.9.1
 	github.com/grafov/m3u8 v0.11.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -33,5 +34,4 @@ require (
 	golang.org/x/sys v0.8.0 // indirect
 	golang.org/x/text v0.9.0 // indirect
 	google.golang.org/protobuf v1.30.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -2,14 +2,19 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"github.com/abema/go-mp4"
 	"github.com/gin-gonic/gin"
 	"github.com/grafov/m3u8"
 	"gopkg.in/yaml.v3"
+	"html"
 	"io"
 	"io/ioutil"
 	"log"
@@ -22,18 +27,29 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 const (
 	defaultId   = "0"
 	prefetchKey = "skd://itunes.apple.com/P000000000/s1/e1"
+	apiRoot     = "https://amp-api.music.apple.com"
 )
 
 var (
-	forbiddenNames = regexp.MustCompile(`[/\\<>:"|?*]`)
+	templateField = regexp.MustCompile(`\{(\w+)(?::(\d+))?\}`)
+	// 各文件系统不允许出现在文件名中的字符
+	forbiddenNames = map[string]*regexp.Regexp{
+		"windows": regexp.MustCompile(`[/\\<>:"|?*\x00-\x1f]`),
+		"macos":   regexp.MustCompile(`[/:\x00]`),
+		"linux":   regexp.MustCompile(`[/\x00]`),
+	}
+	windowsReservedNames = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com\d|lpt\d)(\.|$)`)
 )
 
 const (
@@ -176,16 +192,37 @@ func extractSong(url string) (*SongInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(enca) == 0 {
+		return nil, errors.New("enca not found")
+	}
 
-	aalac, err := mp4.ExtractBoxWithPayload(f, &enca[0].Info,
-		[]mp4.BoxType{BoxTypeAlac()})
-	if err != nil || len(aalac) != 1 {
+	// 原始格式记录在 sinf/frma 中: alac、mp4a 或 ec-3
+	frma, err := mp4.ExtractBoxWithPayload(f, &enca[0].Info, []mp4.BoxType{
+		mp4.BoxTypeSinf(),
+		mp4.BoxTypeFrma(),
+	})
+	if err != nil {
 		return nil, err
 	}
+	format := BoxTypeAlac()
+	if len(frma) == 1 {
+		format = mp4.BoxType(frma[0].Payload.(*mp4.Frma).DataFormat)
+	}
 
 	extracted := &SongInfo{
-		r:         f,
-		alacParam: aalac[0].Payload.(*Alac),
+		r:           f,
+		format:      format,
+		sampleEntry: &enca[0].Info,
+		entryParam:  enca[0].Payload.(*mp4.AudioSampleEntry),
+	}
+
+	if format == BoxTypeAlac() {
+		aalac, err := mp4.ExtractBoxWithPayload(f, &enca[0].Info,
+			[]mp4.BoxType{BoxTypeAlac()})
+		if err != nil || len(aalac) != 1 {
+			return nil, err
+		}
+		extracted.alacParam = aalac[0].Payload.(*Alac)
 	}
 
 	moofs, err := mp4.ExtractBox(f, nil, []mp4.BoxType{
@@ -257,61 +294,258 @@ func extractSong(url string) (*SongInfo, error) {
 			return nil, errors.New("offset mismatch")
 		}
 	}
+	err = extracted.readGapless()
+	if err != nil {
+		return nil, err
+	}
 	end := time.Now()
 	fmt.Println("Extracted in", end.Sub(start))
 	return extracted, nil
 }
-func rip(albumId string, token string, storefront string) error {
+
+// rip 按任务设置下载专辑，songIds 不为空时只下载其中的曲目，返回曲目 ID 到文件路径的映射
+func rip(task *Task, albumId string, songIds []string) (map[string]string, error) {
+	root, storefront := task.root(), task.Storefront
 	var failed bool
-	meta, err := getMeta(albumId, token, storefront)
+	paths := make(map[string]string)
+	meta, err := getMeta(albumId, storefront, task.language())
 	if err != nil {
-		fmt.Println("Failed to get album metadata.\n")
-		return err
+		fmt.Println("Failed to get album metadata.")
+		return paths, err
+	}
+	var secondary *AutoGenerated
+	if config.SecondaryLanguage != "" && config.SecondaryLanguage != task.language() {
+		secondary, err = getMeta(albumId, storefront, config.SecondaryLanguage)
+		if err != nil {
+			fmt.Println("Failed to get secondary language metadata.", err)
+		}
 	}
-	albumFolder := fmt.Sprintf("%s - %s", meta.Data[0].Attributes.ArtistName, meta.Data[0].Attributes.Name)
-	sanAlbumFolder := filepath.Join("AM-DL downloads", forbiddenNames.ReplaceAllString(albumFolder, "_"))
-	os.MkdirAll(sanAlbumFolder, os.ModePerm)
-	fmt.Println(albumFolder)
-	err = writeCover(sanAlbumFolder, meta.Data[0].Attributes.Artwork.URL)
+	album, err := newAlbum(meta, storefront, secondary)
 	if err != nil {
-		fmt.Println("Failed to write cover.")
+		return paths, err
 	}
-	trackTotal := len(meta.Data[0].Relationships.Tracks.Data)
-	for trackNum, track := range meta.Data[0].Relationships.Tracks.Data {
-		trackNum++
-		fmt.Printf("Track %d of %d:\n", trackNum, trackTotal)
-		manifest, err := getInfoFromAdam(track.ID, token, storefront)
-		if err != nil {
-			failed = true
-			fmt.Println("Failed to get manifest.\n", err)
-			continue
+	fmt.Printf("%s - %s\n", album.ArtistName, album.Name)
+	albumArtwork := album.ArtworkURL
+	cover, err := getCover(albumArtwork)
+	if err != nil {
+		fmt.Println("Failed to get cover.")
+	}
+	covers := map[string][]byte{albumArtwork: cover}
+	folderDone := make(map[string]bool)
+	sidecars := make(map[string]*Sidecar)
+	var sidecarFolders []string
+	record := func(albumFolder string, track *Track, trackPath string, stream *StreamInfo, storefront string) {
+		if !config.Sidecar && !config.Nfo {
+			return
 		}
-		if manifest.Attributes.ExtendedAssetUrls.EnhancedHls == "" {
-			fmt.Println("Unavailable in ALAC.")
-			failed = true
-			continue
+		sidecar, ok := sidecars[albumFolder]
+		if !ok {
+			sidecar = &Sidecar{Album: album}
+			sidecars[albumFolder] = sidecar
+			sidecarFolders = append(sidecarFolders, albumFolder)
 		}
-		filename := fmt.Sprintf("%02d. %s.m4a", trackNum, forbiddenNames.ReplaceAllString(track.Attributes.Name, "_"))
-		trackPath := filepath.Join(sanAlbumFolder, filename)
-		exists, err := fileExists(trackPath)
+		file := SidecarFile{TrackID: track.ID, Storefront: storefront, Variant: stream}
+		file.Path, _ = filepath.Rel(albumFolder, trackPath)
+		file.Path = filepath.ToSlash(file.Path)
+		sum, err := fileSha256(trackPath)
 		if err != nil {
-			failed = true
-			fmt.Println("Failed to check if track exists.")
+			fmt.Println("Failed to hash track.", err)
+		}
+		file.SHA256 = sum
+		sidecar.Files = append(sidecar.Files, file)
+	}
+	albumFields := map[string]string{
+		"albumArtist": album.ArtistName,
+		"album":       album.Name,
+		"year":        album.Year,
+		"upc":         album.Upc,
+		"storefront":  storefront,
+	}
+	streamNaming := usesStreamFields(config.AlbumFolderFormat, config.DiscFolderFormat, config.SongFileFormat, config.MultiDiscFileFormat)
+	locate := func(fields map[string]string) (albumFolder, trackFolder, trackPath string) {
+		albumFolder = filepath.Join(root, formatName(config.AlbumFolderFormat, fields, 0))
+		trackFolder = albumFolder
+		fileFormat := config.SongFileFormat
+		if album.DiscTotal > 1 {
+			if config.DiscFolders {
+				trackFolder = filepath.Join(albumFolder, formatName(config.DiscFolderFormat, fields, 0))
+			} else {
+				fileFormat = config.MultiDiscFileFormat
+			}
+		}
+		trackPath = filepath.Join(trackFolder, formatName(fileFormat, fields, len(".m4a"))+".m4a")
+		return
+	}
+	prepareFolder := func(albumFolder, trackFolder string) {
+		os.MkdirAll(trackFolder, os.ModePerm)
+		if folderDone[albumFolder] {
+			return
+		}
+		folderDone[albumFolder] = true
+		if len(cover) > 0 {
+			err := writeCover(albumFolder, cover)
+			if err != nil {
+				fmt.Println("Failed to write cover.")
+			}
+		}
+		if config.Description {
+			err := writeDescription(albumFolder, album)
+			if err != nil {
+				fmt.Println("Failed to write description.", err)
+			}
+		}
+	}
+	wanted := make(map[string]bool)
+	for _, id := range songIds {
+		wanted[id] = true
+	}
+	songsFound := 0
+	fail := func(track *Track, msg string, err error) {
+		failed = true
+		fmt.Println(msg, err)
+		task.Failures = append(task.Failures, TrackFailure{
+			ID:     track.ID,
+			Name:   track.Name,
+			Reason: failureReason(err),
+			Error:  err.Error(),
+		})
+	}
+	var trackIds []string
+	for _, track := range album.Tracks {
+		if len(wanted) == 0 || wanted[track.ID] {
+			trackIds = append(trackIds, track.ID)
+		}
+	}
+	manifests, err := getInfosFromAdam(trackIds, storefront)
+	if err != nil {
+		fmt.Println("Failed to get manifests in batch, falling back to per-track lookups.", err)
+	}
+	for _, track := range album.Tracks {
+		if len(wanted) != 0 {
+			if !wanted[track.ID] {
+				continue
+			}
+			songsFound++
+		}
+		fmt.Printf("Track %d of %d:\n", track.Position, len(album.Tracks))
+		fields := map[string]string{
+			"disc":   strconv.Itoa(track.DiscNumber),
+			"track":  strconv.Itoa(track.TrackNumber),
+			"title":  track.Name,
+			"artist": track.ArtistName,
+			"isrc":   track.Isrc,
 		}
-		if exists {
+		for k, v := range albumFields {
+			fields[k] = v
+		}
+		var albumFolder, trackFolder, trackPath string
+		var exists bool
+		// findExisting 路径依赖音质时，取不到播放列表也按模板查找已下载的文件，找到时不算失败
+		findExisting := func() bool {
+			if !streamNaming {
+				return false
+			}
+			pattern := make(map[string]string)
+			for k, v := range fields {
+				pattern[k] = v
+			}
+			for k := range streamFieldNames {
+				pattern[k] = namePlaceholder
+			}
+			albumFolder, _, p := locate(pattern)
+			found, ok := matchPath(root, p)
+			if !ok {
+				return false
+			}
+			// 专辑文件夹也可能含有通配字段，按层数从找到的路径中取
+			albumRel, _ := filepath.Rel(root, albumFolder)
+			foundRel, _ := filepath.Rel(root, found)
+			depth := len(strings.Split(albumRel, string(filepath.Separator)))
+			foundParts := strings.Split(foundRel, string(filepath.Separator))
 			fmt.Println("Track already exists locally.")
-			continue
+			paths[track.ID] = found
+			record(filepath.Join(append([]string{root}, foundParts[:depth]...)...), track, found, nil, "")
+			return true
 		}
-		trackUrl, keys, err := extractMedia(manifest.Attributes.ExtendedAssetUrls.EnhancedHls)
-		if err != nil {
-			failed = true
-			fmt.Println("Failed to extract info from manifest.\n", err)
-			continue
+		if !streamNaming {
+			// 路径与音质无关时先检查文件，已存在的曲目不再请求播放列表
+			albumFolder, trackFolder, trackPath = locate(fields)
+			prepareFolder(albumFolder, trackFolder)
+			exists, err = fileExists(trackPath)
+			if err != nil {
+				fail(track, "Failed to check if track exists.", err)
+			}
+			if exists {
+				fmt.Println("Track already exists locally.")
+				paths[track.ID] = trackPath
+				record(albumFolder, track, trackPath, nil, "")
+				continue
+			}
 		}
-		info, err := extractSong(trackUrl)
+		trackStorefront := storefront
+		manifest, ok := manifests[track.ID]
+		var lookupErr error
+		if !ok {
+			manifest, lookupErr = getInfoFromAdam(track.ID, storefront)
+		}
+		if lookupErr == nil && manifest.Attributes.ExtendedAssetUrls.EnhancedHls == "" {
+			lookupErr = ErrUnavailable
+		}
+		var stream *StreamInfo
+		if lookupErr != nil {
+			fallbacks := otherStorefronts(config.FallbackStorefronts, storefront)
+			if len(fallbacks) == 0 {
+				if findExisting() {
+					continue
+				}
+				fail(track, "Failed to get manifest.\n", lookupErr)
+				continue
+			}
+			fmt.Printf("Unavailable in %s, trying %s.\n", storefront, strings.Join(fallbacks, ", "))
+			manifest, stream, trackStorefront, err = findInStorefronts(track, fallbacks, task.quality())
+			if err != nil {
+				if findExisting() {
+					continue
+				}
+				fail(track, "Failed to get manifest.\n", err)
+				continue
+			}
+			fmt.Println("Using storefront", trackStorefront)
+			if task.TrackStorefronts == nil {
+				task.TrackStorefronts = make(map[string]string)
+			}
+			task.TrackStorefronts[track.ID] = trackStorefront
+		} else {
+			stream, err = extractMedia(manifest.Attributes.ExtendedAssetUrls.EnhancedHls, task.quality())
+			if err != nil {
+				if findExisting() {
+					continue
+				}
+				fail(track, "Failed to extract info from manifest.\n", err)
+				continue
+			}
+		}
+		keys := stream.Keys
+		if streamNaming {
+			for k, v := range streamFields(stream) {
+				fields[k] = v
+			}
+			albumFolder, trackFolder, trackPath = locate(fields)
+			prepareFolder(albumFolder, trackFolder)
+			exists, err = fileExists(trackPath)
+			if err != nil {
+				fail(track, "Failed to check if track exists.", err)
+			}
+			if exists {
+				fmt.Println("Track already exists locally.")
+				paths[track.ID] = trackPath
+				record(albumFolder, track, trackPath, nil, "")
+				continue
+			}
+		}
+		info, err := extractSong(stream.URL)
 		if err != nil {
-			failed = true
-			fmt.Println("Failed to extract track.", err)
+			fail(track, "Failed to extract track.", err)
 			continue
 		}
 		samplesOk := true
@@ -325,22 +559,296 @@ func rip(albumId string, token string, storefront string) error {
 			break
 		}
 		if !samplesOk {
+			fail(track, "Failed to decrypt track.", errors.New("decryption size mismatch"))
 			continue
 		}
-		err = decryptSong(info, keys, meta, trackPath, trackNum, trackTotal)
+		trackCover := cover
+		if artwork := track.ArtworkURL; artwork != "" && artwork != albumArtwork {
+			c, ok := covers[artwork]
+			if !ok {
+				c, err = getCover(artwork)
+				if err != nil {
+					fmt.Println("Failed to get track cover.")
+				}
+				covers[artwork] = c
+			}
+			if len(c) > 0 {
+				trackCover = c
+			}
+		}
+		var lyrics *Lyrics
+		if config.Lyrics && config.MediaUserToken != "" && track.HasLyrics {
+			lyrics, err = getLyrics(manifest.ID, trackStorefront)
+			if err != nil {
+				fmt.Println("Failed to get lyrics.", err)
+			}
+		}
+		if config.Credits {
+			track.Credits, err = getCredits(manifest.ID, trackStorefront)
+			if err != nil {
+				fmt.Println("Failed to get credits.", err)
+			}
+		}
+		var plainLyrics string
+		if lyrics != nil && config.EmbedLyrics {
+			plainLyrics = lyrics.Plain
+		}
+		err = decryptSong(info, manifest.ID, keys, track, trackPath, trackCover, plainLyrics)
 		if err != nil {
-			failed = true
-			fmt.Println("Failed to decrypt track.\n", err)
+			fail(track, "Failed to decrypt track.\n", err)
 			continue
 		}
+		paths[track.ID] = trackPath
+		record(albumFolder, track, trackPath, stream, trackStorefront)
+		if lyrics != nil {
+			err = writeLyrics(trackPath, lyrics)
+			if err != nil {
+				fmt.Println("Failed to write lyrics.", err)
+			}
+		}
+	}
+	for _, folder := range sidecarFolders {
+		err = writeSidecar(folder, sidecars[folder])
+		if err != nil {
+			fmt.Println("Failed to write sidecar.", err)
+		}
+	}
+	if songsFound < len(wanted) {
+		return paths, errors.New("song not found in album")
 	}
 	if failed {
-		return errors.New("some tracks failed to download")
+		return paths, errors.New("some tracks failed to download")
 	}
-	return err
+	return paths, nil
+}
+
+// streamFieldNames 取决于所选版本的命名字段
+var streamFieldNames = map[string]bool{"bitDepth": true, "sampleRate": true, "bitrate": true, "codec": true}
+
+// templateFieldNames 命名模板可用的全部字段
+var templateFieldNames = map[string]bool{
+	"albumArtist": true, "album": true, "year": true, "upc": true, "storefront": true,
+	"disc": true, "track": true, "title": true, "artist": true, "isrc": true,
+	"bitDepth": true, "sampleRate": true, "bitrate": true, "codec": true,
+}
+
+// checkTemplate 检查模板中是否有未知字段，避免拼写错误的字段原样出现在文件名中
+func checkTemplate(template string) error {
+	for _, m := range templateField.FindAllStringSubmatch(template, -1) {
+		if !templateFieldNames[m[1]] {
+			return fmt.Errorf("unknown field %q in %q", m[0], template)
+		}
+	}
+	return nil
+}
+
+// usesStreamFields 判断模板是否用到版本相关的字段，用到时需要先解析播放列表才能确定路径
+func usesStreamFields(templates ...string) bool {
+	for _, template := range templates {
+		for _, m := range templateField.FindAllStringSubmatch(template, -1) {
+			if streamFieldNames[m[1]] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// namePlaceholder 代替未知的命名字段，matchPath 将其视为通配
+const namePlaceholder = "\uE000"
+
+// matchPath 在 root 下逐级查找与 pattern 匹配的文件，pattern 中的 namePlaceholder 匹配任意字符
+func matchPath(root string, pattern string) (string, bool) {
+	rel, err := filepath.Rel(root, pattern)
+	if err != nil {
+		return "", false
+	}
+	dirs := []string{root}
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i, part := range parts {
+		re, err := regexp.Compile("^" + strings.Replace(regexp.QuoteMeta(part), namePlaceholder, ".*", -1) + "$")
+		if err != nil {
+			return "", false
+		}
+		var next []string
+		for _, dir := range dirs {
+			entries, err := ioutil.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				last := i == len(parts)-1
+				if entry.IsDir() == last || !re.MatchString(entry.Name()) {
+					continue
+				}
+				next = append(next, filepath.Join(dir, entry.Name()))
+			}
+		}
+		dirs = next
+	}
+	if len(dirs) == 0 {
+		return "", false
+	}
+	// 有多个匹配时按路径排序，保证每次选中同一个
+	sort.Strings(dirs)
+	return dirs[0], true
+}
+
+func streamFields(stream *StreamInfo) map[string]string {
+	return map[string]string{
+		"bitDepth":   stream.BitDepth,
+		"sampleRate": stream.SampleRate,
+		"bitrate":    stream.Bitrate,
+		"codec":      stream.Codec,
+	}
+}
+
+// trackPosition 返回接口中的碟号和碟内编号，缺失时退回到专辑中的位置
+func trackPosition(track AlbumTrack, position int) (int, int) {
+	discNum, trackNum := track.Attributes.DiscNumber, track.Attributes.TrackNumber
+	if discNum == 0 {
+		discNum = 1
+	}
+	if trackNum == 0 {
+		trackNum = position
+	}
+	return discNum, trackNum
+}
+
+// discCounts 返回碟数以及每张碟的曲目数
+func discCounts(tracks []AlbumTrack) (int, map[int]int) {
+	discTotal := 1
+	discTrackTotals := make(map[int]int)
+	for i, track := range tracks {
+		discNum, trackNum := trackPosition(track, i+1)
+		if discNum > discTotal {
+			discTotal = discNum
+		}
+		if trackNum > discTrackTotals[discNum] {
+			discTrackTotals[discNum] = trackNum
+		}
+	}
+	return discTotal, discTrackTotals
+}
+
+// Album 由 AutoGenerated 整理出的专辑信息，命名、标签、解密和任务报告都只使用它
+type Album struct {
+	ID            string   `json:"id"`
+	Name          string   `json:"name"`
+	ArtistName    string   `json:"artistName"`
+	ReleaseDate   string   `json:"releaseDate"`
+	Year          string   `json:"year"`
+	Upc           string   `json:"upc"`
+	RecordLabel   string   `json:"recordLabel"`
+	Copyright     string   `json:"copyright"`
+	IsCompilation bool     `json:"isCompilation"`
+	ArtworkURL    string   `json:"artworkUrl"`
+	AudioTraits   []string `json:"audioTraits"`
+	Storefront    string   `json:"storefront"`
+	DiscTotal     int      `json:"discTotal"`
+	Tracks        []*Track `json:"tracks"`
+
+	EditorialNotes       EditorialNotes `json:"editorialNotes"`
+	ArtistEditorialNotes EditorialNotes `json:"artistEditorialNotes"`
+
+	// 第二语言下的专辑名和专辑艺人，未获取时为空
+	AltName       string `json:"altName,omitempty"`
+	AltArtistName string `json:"altArtistName,omitempty"`
+}
+
+// Track 专辑中的一首曲目，碟号和编号已按 trackPosition 补齐
+type Track struct {
+	ID             string   `json:"id"`
+	Name           string   `json:"name"`
+	ArtistName     string   `json:"artistName"`
+	ArtistID       string   `json:"artistId"`
+	ComposerName   string   `json:"composerName"`
+	Isrc           string   `json:"isrc"`
+	GenreNames     []string `json:"genreNames"`
+	ContentRating  string   `json:"contentRating"`
+	ArtworkURL     string   `json:"artworkUrl"`
+	AudioTraits    []string `json:"audioTraits"`
+	HasLyrics      bool     `json:"hasLyrics"`
+	Position       int      `json:"position"` // 在专辑中的位置，从 1 开始
+	DiscNumber     int      `json:"discNumber"`
+	TrackNumber    int      `json:"trackNumber"`
+	DiscTrackTotal int      `json:"discTrackTotal"`
+
+	// 第二语言下的曲名和艺人，按曲目 ID 对应，未获取时为空
+	AltName       string `json:"altName,omitempty"`
+	AltArtistName string `json:"altArtistName,omitempty"`
+
+	Credits []Credit `json:"credits,omitempty"` // 开启 credits 时获取
+
+	Album *Album `json:"-"`
+}
+
+// newAlbum 从接口返回的专辑信息构建 Album，secondary 为第二语言的同一专辑，可以为 nil
+func newAlbum(meta *AutoGenerated, storefront string, secondary *AutoGenerated) (*Album, error) {
+	if meta == nil || len(meta.Data) == 0 {
+		return nil, errors.New("album not found")
+	}
+	data := meta.Data[0]
+	album := &Album{
+		ID:            data.ID,
+		Name:          data.Attributes.Name,
+		ArtistName:    data.Attributes.ArtistName,
+		ReleaseDate:   data.Attributes.ReleaseDate,
+		Year:          strings.Split(data.Attributes.ReleaseDate, "-")[0],
+		Upc:           data.Attributes.Upc,
+		RecordLabel:   data.Attributes.RecordLabel,
+		Copyright:     data.Attributes.Copyright,
+		IsCompilation: data.Attributes.IsCompilation,
+		ArtworkURL:    data.Attributes.Artwork.URL,
+		AudioTraits:   data.Attributes.AudioTraits,
+		Storefront:    storefront,
+
+		EditorialNotes: data.Attributes.EditorialNotes,
+	}
+	if len(data.Relationships.Artists.Data) > 0 {
+		album.ArtistEditorialNotes = data.Relationships.Artists.Data[0].Attributes.EditorialNotes
+	}
+	discTotal, discTrackTotals := discCounts(data.Relationships.Tracks.Data)
+	album.DiscTotal = discTotal
+	for i, t := range data.Relationships.Tracks.Data {
+		track := &Track{
+			ID:            t.ID,
+			Name:          t.Attributes.Name,
+			ArtistName:    t.Attributes.ArtistName,
+			ComposerName:  t.Attributes.ComposerName,
+			Isrc:          t.Attributes.Isrc,
+			GenreNames:    t.Attributes.GenreNames,
+			ContentRating: t.Attributes.ContentRating,
+			ArtworkURL:    t.Attributes.Artwork.URL,
+			AudioTraits:   t.Attributes.AudioTraits,
+			HasLyrics:     t.Attributes.HasLyrics,
+			Position:      i + 1,
+			Album:         album,
+		}
+		if len(t.Relationships.Artists.Data) > 0 {
+			track.ArtistID = t.Relationships.Artists.Data[0].ID
+		}
+		track.DiscNumber, track.TrackNumber = trackPosition(t, i+1)
+		track.DiscTrackTotal = discTrackTotals[track.DiscNumber]
+		album.Tracks = append(album.Tracks, track)
+	}
+	if secondary != nil && len(secondary.Data) > 0 {
+		alt := secondary.Data[0]
+		album.AltName, album.AltArtistName = alt.Attributes.Name, alt.Attributes.ArtistName
+		altTracks := make(map[string]AlbumTrack)
+		for _, t := range alt.Relationships.Tracks.Data {
+			altTracks[t.ID] = t
+		}
+		for _, track := range album.Tracks {
+			if t, ok := altTracks[track.ID]; ok {
+				track.AltName, track.AltArtistName = t.Attributes.Name, t.Attributes.ArtistName
+			}
+		}
+	}
+	return album, nil
 }
 
-func getInfoFromAdam(adamId string, token string, storefront string) (*SongData, error) {
+func getInfoFromAdam(adamId string, storefront string) (*SongData, error) {
 	request, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/songs/%s", storefront, adamId), nil)
 	if err != nil {
 		return nil, err
@@ -350,17 +858,16 @@ func getInfoFromAdam(adamId string, token string, storefront string) (*SongData,
 	query.Set("include", "albums")
 	request.URL.RawQuery = query.Encode()
 
-	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	request.Header.Set("User-Agent", "iTunes/12.11.3 (Windows; Microsoft Windows 10 x64 Professional Edition (Build 19041); x64) AppleWebKit/7611.1022.4001.1 (dt:2)")
 	request.Header.Set("Origin", "https://music.apple.com")
 
-	do, err := http.DefaultClient.Do(request)
+	do, err := doApi(request)
 	if err != nil {
 		return nil, err
 	}
 	defer do.Body.Close()
 	if do.StatusCode != http.StatusOK {
-		return nil, errors.New(do.Status)
+		return nil, newApiError(do)
 	}
 
 	obj := new(ApiResult)
@@ -374,95 +881,1204 @@ func getInfoFromAdam(adamId string, token string, storefront string) (*SongData,
 			return &d, nil
 		}
 	}
-	return nil, nil
+	return nil, fmt.Errorf("song %s: %w", adamId, ErrNotFound)
 }
 
-func getToken() (string, error) {
-	req, err := http.NewRequest("GET", "https://beta.music.apple.com", nil)
-	if err != nil {
-		return "", err
+// otherStorefronts 去掉已经尝试过的 storefront
+func otherStorefronts(storefronts []string, tried string) []string {
+	var others []string
+	for _, sf := range storefronts {
+		if sf != "" && sf != tried {
+			others = append(others, sf)
+		}
 	}
+	return others
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// getSongsByIsrc 在指定地区按 ISRC 查找曲目
+func getSongsByIsrc(isrc string, storefront string) ([]SongData, error) {
+	query := url.Values{}
+	query.Set("filter[isrc]", isrc)
+	query.Set("extend", "extendedAssetUrls")
+	query.Set("include", "albums")
+	obj := new(ApiResult)
+	err := getApi(fmt.Sprintf("%s/v1/catalog/%s/songs", apiRoot, storefront), query, obj)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer resp.Body.Close()
+	return obj.Data, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+// findInStorefronts 在备用地区中按 ID 和 ISRC 查找曲目，优先使用有 ALAC 的版本，都没有时使用第一个可用的版本
+func findInStorefronts(track *Track, storefronts []string, policy *QualityPolicy) (*SongData, *StreamInfo, string, error) {
+	var (
+		best       *SongData
+		bestStream *StreamInfo
+		bestSf     string
+	)
+	for _, sf := range storefronts {
+		var candidates []SongData
+		if song, err := getInfoFromAdam(track.ID, sf); err == nil {
+			candidates = append(candidates, *song)
+		}
+		if track.Isrc != "" {
+			songs, err := getSongsByIsrc(track.Isrc, sf)
+			if err == nil {
+				candidates = append(candidates, songs...)
+			}
+		}
+		for i := range candidates {
+			hls := candidates[i].Attributes.ExtendedAssetUrls.EnhancedHls
+			if hls == "" {
+				continue
+			}
+			stream, err := extractMedia(hls, policy)
+			if err != nil {
+				continue
+			}
+			if stream.Codec == "alac" {
+				return &candidates[i], stream, sf, nil
+			}
+			if best == nil {
+				best, bestStream, bestSf = &candidates[i], stream, sf
+			}
+		}
 	}
-
-	regex := regexp.MustCompile(`/assets/index-legacy-[^/]+\.js`)
-	indexJsUri := regex.FindString(string(body))
-
-	req, err = http.NewRequest("GET", "https://beta.music.apple.com"+indexJsUri, nil)
-	if err != nil {
-		return "", err
+	if best != nil {
+		return best, bestStream, bestSf, nil
 	}
+	return nil, nil, "", fmt.Errorf("not available in %s: %w", strings.Join(storefronts, ", "), ErrNotFound)
+}
 
-	resp, err = http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
+const songBatchSize = 300
 
-	body, err = io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+// getInfosFromAdam 使用 songs?ids= 批量获取曲目信息，缺失的曲目不在返回的 map 中
+func getInfosFromAdam(adamIds []string, storefront string) (map[string]*SongData, error) {
+	infos := make(map[string]*SongData)
+	for start := 0; start < len(adamIds); start += songBatchSize {
+		end := start + songBatchSize
+		if end > len(adamIds) {
+			end = len(adamIds)
+		}
+		query := url.Values{}
+		query.Set("ids", strings.Join(adamIds[start:end], ","))
+		query.Set("extend", "extendedAssetUrls")
+		query.Set("include", "albums")
+		obj := new(ApiResult)
+		err := getApi(fmt.Sprintf("%s/v1/catalog/%s/songs", apiRoot, storefront), query, obj)
+		if err != nil {
+			return infos, err
+		}
+		for i := range obj.Data {
+			infos[obj.Data[i].ID] = &obj.Data[i]
+		}
 	}
+	return infos, nil
+}
 
-	regex = regexp.MustCompile(`eyJh([^"]*)`)
-	token := regex.FindString(string(body))
-
-	return token, nil
+type LyricsResult struct {
+	Data []struct {
+		ID         string `json:"id"`
+		Type       string `json:"type"`
+		Attributes struct {
+			Ttml string `json:"ttml"`
+		} `json:"attributes"`
+	} `json:"data"`
 }
 
-type ApiResult struct {
-	Data []SongData `json:"data"`
+type ttmlDoc struct {
+	Timing string `xml:"timing,attr"`
+	Body   struct {
+		Divs []struct {
+			Lines []struct {
+				Begin string `xml:"begin,attr"`
+				Text  string `xml:",innerxml"`
+			} `xml:"p"`
+		} `xml:"div"`
+	} `xml:"body"`
 }
 
-type SongAttributes struct {
-	ArtistName        string   `json:"artistName"`
-	DiscNumber        int      `json:"discNumber"`
-	GenreNames        []string `json:"genreNames"`
-	ExtendedAssetUrls struct {
-		EnhancedHls string `json:"enhancedHls"`
-	} `json:"extendedAssetUrls"`
-	IsMasteredForItunes bool   `json:"isMasteredForItunes"`
-	ReleaseDate         string `json:"releaseDate"`
-	Name                string `json:"name"`
-	Isrc                string `json:"isrc"`
-	AlbumName           string `json:"albumName"`
-	TrackNumber         int    `json:"trackNumber"`
-	ComposerName        string `json:"composerName"`
+type Lyrics struct {
+	Synced bool
+	Lrc    string
+	Plain  string
 }
 
-type AlbumAttributes struct {
-	ArtistName          string   `json:"artistName"`
-	IsSingle            bool     `json:"isSingle"`
-	IsComplete          bool     `json:"isComplete"`
-	GenreNames          []string `json:"genreNames"`
-	TrackCount          int      `json:"trackCount"`
-	IsMasteredForItunes bool     `json:"isMasteredForItunes"`
-	ReleaseDate         string   `json:"releaseDate"`
-	Name                string   `json:"name"`
-	RecordLabel         string   `json:"recordLabel"`
-	Upc                 string   `json:"upc"`
-	Copyright           string   `json:"copyright"`
-	IsCompilation       bool     `json:"isCompilation"`
+// Credit 曲目的一位参与者及其角色，Category 为接口中的分类，如 performer、production
+type Credit struct {
+	Name     string   `json:"name"`
+	Roles    []string `json:"roles"`
+	Category string   `json:"category"`
 }
 
-type SongData struct {
-	ID            string         `json:"id"`
-	Attributes    SongAttributes `json:"attributes"`
-	Relationships struct {
-		Albums struct {
-			Data []struct {
-				ID         string          `json:"id"`
-				Type       string          `json:"type"`
-				Href       string          `json:"href"`
+type CreditsResult struct {
+	Data []struct {
+		ID         string `json:"id"`
+		Type       string `json:"type"`
+		Attributes struct {
+			Title string `json:"title"`
+			Kind  string `json:"kind"`
+		} `json:"attributes"`
+		Relationships struct {
+			CreditArtists struct {
+				Data []struct {
+					ID         string `json:"id"`
+					Attributes struct {
+						Name      string   `json:"name"`
+						RoleNames []string `json:"roleNames"`
+					} `json:"attributes"`
+				} `json:"data"`
+			} `json:"credit-artists"`
+		} `json:"relationships"`
+	} `json:"data"`
+}
+
+// getCredits 获取曲目的 credits 关系
+func getCredits(adamId string, storefront string) ([]Credit, error) {
+	obj := new(CreditsResult)
+	err := getApi(fmt.Sprintf("%s/v1/catalog/%s/songs/%s/credits", apiRoot, storefront, adamId), nil, obj)
+	if err != nil {
+		return nil, err
+	}
+	var credits []Credit
+	for _, category := range obj.Data {
+		kind := category.Attributes.Kind
+		if kind == "" {
+			kind = strings.ToLower(category.Attributes.Title)
+		}
+		for _, artist := range category.Relationships.CreditArtists.Data {
+			credits = append(credits, Credit{
+				Name:     artist.Attributes.Name,
+				Roles:    artist.Attributes.RoleNames,
+				Category: kind,
+			})
+		}
+	}
+	return credits, nil
+}
+
+// creditRoleTags 角色到 freeform 标签名，作曲已写入©wrt，未列出的表演者写入 PERFORMER
+var creditRoleTags = map[string]string{
+	"conductor":          "CONDUCTOR",
+	"orchestra":          "ENSEMBLE",
+	"ensemble":           "ENSEMBLE",
+	"choir":              "ENSEMBLE",
+	"chorus":             "ENSEMBLE",
+	"producer":           "PRODUCER",
+	"co-producer":        "PRODUCER",
+	"executive producer": "PRODUCER",
+	"arranger":           "ARRANGER",
+	"lyricist":           "LYRICIST",
+	"mixing engineer":    "MIXER",
+	"mastering engineer": "MASTERING",
+	"recording engineer": "ENGINEER",
+	"engineer":           "ENGINEER",
+}
+
+type creditTag struct {
+	Name  string
+	Value string
+}
+
+// creditTags 将 credits 转成 freeform 标签，同名标签按出现顺序写多个
+func creditTags(credits []Credit) []creditTag {
+	var tags []creditTag
+	seen := make(map[creditTag]bool)
+	add := func(tag creditTag) {
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	for _, credit := range credits {
+		for _, role := range credit.Roles {
+			if name, ok := creditRoleTags[strings.ToLower(role)]; ok {
+				add(creditTag{name, credit.Name})
+			} else if strings.Contains(credit.Category, "perform") {
+				add(creditTag{"PERFORMER", fmt.Sprintf("%s (%s)", credit.Name, role)})
+			}
+		}
+	}
+	return tags
+}
+
+func getLyrics(adamId string, storefront string) (*Lyrics, error) {
+	request, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/songs/%s/lyrics", storefront, adamId), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", "iTunes/12.11.3 (Windows; Microsoft Windows 10 x64 Professional Edition (Build 19041); x64) AppleWebKit/7611.1022.4001.1 (dt:2)")
+	request.Header.Set("Origin", "https://music.apple.com")
+
+	do, err := doApi(request)
+	if err != nil {
+		return nil, err
+	}
+	defer do.Body.Close()
+	if do.StatusCode != http.StatusOK {
+		return nil, newApiError(do)
+	}
+
+	obj := new(LyricsResult)
+	err = json.NewDecoder(do.Body).Decode(&obj)
+	if err != nil {
+		return nil, err
+	}
+	if len(obj.Data) == 0 || obj.Data[0].Attributes.Ttml == "" {
+		return nil, errors.New("no lyrics")
+	}
+	return ttmlToLyrics(obj.Data[0].Attributes.Ttml)
+}
+
+// markupTags 匹配 TTML 歌词和推荐语中的标签
+var markupTags = regexp.MustCompile(`<[^>]*>`)
+
+// ttmlToLyrics 将 TTML 转为 LRC 和纯文本，段落之间空一行
+func ttmlToLyrics(ttml string) (*Lyrics, error) {
+	var doc ttmlDoc
+	err := xml.Unmarshal([]byte(ttml), &doc)
+	if err != nil {
+		return nil, err
+	}
+	lyrics := &Lyrics{Synced: doc.Timing != "None"}
+	var lrc, plain strings.Builder
+	for i, div := range doc.Body.Divs {
+		if i > 0 {
+			plain.WriteString("\n")
+		}
+		for _, line := range div.Lines {
+			text := strings.TrimSpace(html.UnescapeString(markupTags.ReplaceAllString(line.Text, "")))
+			plain.WriteString(text + "\n")
+			if !lyrics.Synced {
+				continue
+			}
+			begin, err := parseTtmlTime(line.Begin)
+			if err != nil {
+				lyrics.Synced = false
+				continue
+			}
+			centis := begin.Milliseconds() / 10
+			lrc.WriteString(fmt.Sprintf("[%02d:%02d.%02d]%s\n", centis/6000, centis/100%60, centis%100, text))
+		}
+	}
+	lyrics.Plain = strings.TrimSpace(plain.String())
+	if lyrics.Synced {
+		lyrics.Lrc = lrc.String()
+	}
+	return lyrics, nil
+}
+
+// parseTtmlTime 支持 "12.345"、"1:02.345"、"1:02:03.345" 和 "12.345s"
+func parseTtmlTime(t string) (time.Duration, error) {
+	parts := strings.Split(strings.TrimSuffix(t, "s"), ":")
+	var seconds float64
+	for _, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, err
+		}
+		seconds = seconds*60 + v
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func writeLyrics(trackPath string, lyrics *Lyrics) error {
+	base := strings.TrimSuffix(trackPath, filepath.Ext(trackPath))
+	if lyrics.Synced {
+		return ioutil.WriteFile(base+".lrc", []byte(lyrics.Lrc), 0644)
+	}
+	return ioutil.WriteFile(base+".txt", []byte(lyrics.Plain), 0644)
+}
+
+var htmlBreakPat = regexp.MustCompile(`(?i)<br\s*/?>`)
+
+// notesText 将推荐语中的 HTML 转成纯文本，<br> 视为换行
+func notesText(notes string) string {
+	notes = htmlBreakPat.ReplaceAllString(notes, "\n")
+	return strings.TrimSpace(html.UnescapeString(markupTags.ReplaceAllString(notes, "")))
+}
+
+// shortDescription 返回写入 desc 的短介绍，没有 short 时截取 standard，desc 最多 255 个字符
+func shortDescription(notes EditorialNotes) string {
+	desc := notesText(notes.Short)
+	if desc == "" {
+		desc = notesText(notes.Standard)
+	}
+	if r := []rune(desc); len(r) > 255 {
+		desc = string(r[:254]) + "…"
+	}
+	return desc
+}
+
+// writeDescription 在专辑文件夹写出 description.txt 和 description.html，没有推荐语时不写
+func writeDescription(folder string, album *Album) error {
+	albumNotes := album.EditorialNotes.Standard
+	if albumNotes == "" {
+		albumNotes = album.EditorialNotes.Short
+	}
+	artistNotes := album.ArtistEditorialNotes.Standard
+	if artistNotes == "" {
+		artistNotes = album.ArtistEditorialNotes.Short
+	}
+	if albumNotes == "" && artistNotes == "" {
+		return nil
+	}
+
+	var txt, htm strings.Builder
+	htm.WriteString("<!DOCTYPE html>\n<html>\n<head><meta charset=\"utf-8\"><title>" + html.EscapeString(album.Name) + "</title></head>\n<body>\n")
+	if albumNotes != "" {
+		txt.WriteString(album.Name + "\n\n" + notesText(albumNotes) + "\n")
+		htm.WriteString("<h1>" + html.EscapeString(album.Name) + "</h1>\n<p>" + albumNotes + "</p>\n")
+	}
+	if artistNotes != "" {
+		if txt.Len() > 0 {
+			txt.WriteString("\n")
+		}
+		txt.WriteString(album.ArtistName + "\n\n" + notesText(artistNotes) + "\n")
+		htm.WriteString("<h2>" + html.EscapeString(album.ArtistName) + "</h2>\n<p>" + artistNotes + "</p>\n")
+	}
+	htm.WriteString("</body>\n</html>\n")
+
+	err := ioutil.WriteFile(filepath.Join(folder, "description.txt"), []byte(txt.String()), 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(folder, "description.html"), []byte(htm.String()), 0644)
+}
+
+// Sidecar 与专辑一起保存的 album.json，记录完整的专辑信息以及每个文件使用的版本、密钥和哈希
+type Sidecar struct {
+	*Album
+	Files []SidecarFile `json:"files"`
+}
+
+type SidecarFile struct {
+	TrackID    string      `json:"trackId"`
+	Path       string      `json:"path"` // 相对于专辑文件夹
+	Storefront string      `json:"storefront,omitempty"`
+	Variant    *StreamInfo `json:"variant,omitempty"` // 本次运行前已存在的文件没有记录时为空
+	SHA256     string      `json:"sha256"`
+}
+
+// albumNfo Kodi 的 album.nfo
+type albumNfo struct {
+	XMLName     xml.Name   `xml:"album"`
+	Title       string     `xml:"title"`
+	Artist      string     `xml:"artistdesc"`
+	Genre       string     `xml:"genre,omitempty"`
+	Year        string     `xml:"year"`
+	ReleaseDate string     `xml:"releasedate"`
+	Label       string     `xml:"label,omitempty"`
+	Compilation bool       `xml:"compilation"`
+	Tracks      []nfoTrack `xml:"track"`
+}
+
+type nfoTrack struct {
+	Disc     int    `xml:"disc,omitempty"`
+	Position int    `xml:"position"`
+	Title    string `xml:"title"`
+}
+
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// mergeSidecar 合并已有 album.json 中仍在磁盘上的文件，已存在的文件沿用原来记录的版本和 storefront
+func mergeSidecar(folder string, sidecar *Sidecar) {
+	b, err := ioutil.ReadFile(filepath.Join(folder, "album.json"))
+	if err != nil {
+		return
+	}
+	old := new(struct {
+		Files []SidecarFile `json:"files"`
+	})
+	err = json.Unmarshal(b, old)
+	if err != nil {
+		fmt.Println("Failed to read existing sidecar.", err)
+		return
+	}
+	oldFiles := make(map[string]SidecarFile)
+	for _, f := range old.Files {
+		oldFiles[f.TrackID] = f
+	}
+	current := make(map[string]bool)
+	for i, f := range sidecar.Files {
+		current[f.TrackID] = true
+		if o, ok := oldFiles[f.TrackID]; ok && f.Variant == nil && o.Path == f.Path {
+			sidecar.Files[i].Variant = o.Variant
+			sidecar.Files[i].Storefront = o.Storefront
+		}
+	}
+	for _, f := range old.Files {
+		if current[f.TrackID] {
+			continue
+		}
+		if exists, _ := fileExists(filepath.Join(folder, filepath.FromSlash(f.Path))); exists {
+			sidecar.Files = append(sidecar.Files, f)
+		}
+	}
+	position := make(map[string]int)
+	for _, track := range sidecar.Album.Tracks {
+		position[track.ID] = track.Position
+	}
+	sort.SliceStable(sidecar.Files, func(i, j int) bool {
+		return position[sidecar.Files[i].TrackID] < position[sidecar.Files[j].TrackID]
+	})
+}
+
+// writeSidecar 按配置写出 album.json 和 album.nfo
+func writeSidecar(folder string, sidecar *Sidecar) error {
+	if config.Sidecar {
+		mergeSidecar(folder, sidecar)
+		b, err := json.MarshalIndent(sidecar, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filepath.Join(folder, "album.json"), b, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	if config.Nfo {
+		album := sidecar.Album
+		nfo := albumNfo{
+			Title:       album.Name,
+			Artist:      album.ArtistName,
+			Year:        album.Year,
+			ReleaseDate: album.ReleaseDate,
+			Label:       album.RecordLabel,
+			Compilation: album.IsCompilation,
+		}
+		for _, track := range album.Tracks {
+			if nfo.Genre == "" && len(track.GenreNames) > 0 {
+				nfo.Genre = track.GenreNames[0]
+			}
+			t := nfoTrack{Position: track.TrackNumber, Title: track.Name}
+			if album.DiscTotal > 1 {
+				t.Disc = track.DiscNumber
+			}
+			nfo.Tracks = append(nfo.Tracks, t)
+		}
+		b, err := xml.MarshalIndent(nfo, "", "  ")
+		if err != nil {
+			return err
+		}
+		b = append([]byte(xml.Header), b...)
+		err = ioutil.WriteFile(filepath.Join(folder, "album.nfo"), b, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getApi 请求 amp-api，link 可以是完整链接也可以是分页返回的 next 路径
+func getApi(link string, query url.Values, v interface{}) error {
+	if strings.HasPrefix(link, "/") {
+		link = apiRoot + link
+	}
+	request, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return err
+	}
+	if query != nil {
+		q := request.URL.Query()
+		for k, vs := range query {
+			q[k] = vs
+		}
+		request.URL.RawQuery = q.Encode()
+	}
+	request.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+	request.Header.Set("Origin", "https://music.apple.com")
+
+	do, err := doApi(request)
+	if err != nil {
+		return err
+	}
+	defer do.Body.Close()
+	if do.StatusCode != http.StatusOK {
+		return newApiError(do)
+	}
+	return json.NewDecoder(do.Body).Decode(v)
+}
+
+type PlaylistTrack struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Attributes struct {
+		Name             string `json:"name"`
+		ArtistName       string `json:"artistName"`
+		AlbumName        string `json:"albumName"`
+		URL              string `json:"url"`
+		DurationInMillis int    `json:"durationInMillis"`
+		PlayParams       struct {
+			ID        string `json:"id"`
+			Kind      string `json:"kind"`
+			CatalogID string `json:"catalogId"`
+		} `json:"playParams"`
+	} `json:"attributes"`
+}
+
+type PlaylistTracks struct {
+	Href string          `json:"href"`
+	Next string          `json:"next"`
+	Data []PlaylistTrack `json:"data"`
+}
+
+type PlaylistResult struct {
+	Data []struct {
+		ID         string `json:"id"`
+		Type       string `json:"type"`
+		Attributes struct {
+			Name        string `json:"name"`
+			CuratorName string `json:"curatorName"`
+		} `json:"attributes"`
+		Relationships struct {
+			Tracks PlaylistTracks `json:"tracks"`
+		} `json:"relationships"`
+	} `json:"data"`
+}
+
+// getPlaylist 获取歌单信息，并按 next 翻页取得全部曲目，p. 开头的资料库歌单会换成对应的目录曲目
+func getPlaylist(playlistId string, storefront string) (string, []PlaylistTrack, error) {
+	link := fmt.Sprintf("%s/v1/catalog/%s/playlists/%s", apiRoot, storefront, playlistId)
+	library := isLibraryId(playlistId)
+	if library {
+		if config.MediaUserToken == "" {
+			return "", nil, errors.New("media_user_token required for library playlists")
+		}
+		link = fmt.Sprintf("%s/v1/me/library/playlists/%s", apiRoot, playlistId)
+	}
+	query := url.Values{}
+	query.Set("include", "tracks")
+	obj := new(PlaylistResult)
+	err := getApi(link, query, obj)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(obj.Data) == 0 {
+		return "", nil, errors.New("playlist not found")
+	}
+	tracks := obj.Data[0].Relationships.Tracks.Data
+	next := obj.Data[0].Relationships.Tracks.Next
+	for next != "" {
+		page := new(PlaylistTracks)
+		err = getApi(next, nil, page)
+		if err != nil {
+			return "", nil, err
+		}
+		tracks = append(tracks, page.Data...)
+		next = page.Next
+	}
+	if library {
+		for i := range tracks {
+			// 上传或已下架的曲目没有 catalogId，保持 library-songs 类型由 ripPlaylist 跳过
+			if catalogId := tracks[i].Attributes.PlayParams.CatalogID; catalogId != "" {
+				tracks[i].ID = catalogId
+				tracks[i].Type = "songs"
+				tracks[i].Attributes.URL = ""
+			}
+		}
+	}
+	return obj.Data[0].Attributes.Name, tracks, nil
+}
+
+// isLibraryId 资料库专辑以 l. 开头，资料库歌单以 p. 开头
+func isLibraryId(id string) bool {
+	return strings.HasPrefix(id, "l.") || strings.HasPrefix(id, "p.")
+}
+
+type CatalogRef struct {
+	Data []struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	} `json:"data"`
+}
+
+// getLibraryAlbum 将资料库专辑 ID 换成目录专辑 ID
+func getLibraryAlbum(libraryId string) (string, error) {
+	if config.MediaUserToken == "" {
+		return "", errors.New("media_user_token required for library albums")
+	}
+	obj := new(CatalogRef)
+	err := getApi(fmt.Sprintf("%s/v1/me/library/albums/%s/catalog", apiRoot, libraryId), nil, obj)
+	if err != nil {
+		return "", err
+	}
+	if len(obj.Data) == 0 {
+		return "", errors.New("library album not in catalog")
+	}
+	return obj.Data[0].ID, nil
+}
+
+// getUserStorefront 资料库链接不带地区，使用账号所在的 storefront
+func getUserStorefront() (string, error) {
+	if config.MediaUserToken == "" {
+		return "", errors.New("media_user_token required for library links")
+	}
+	obj := new(CatalogRef)
+	err := getApi(apiRoot+"/v1/me/storefront", nil, obj)
+	if err != nil {
+		return "", err
+	}
+	if len(obj.Data) == 0 {
+		return "", errors.New("storefront not found")
+	}
+	return obj.Data[0].ID, nil
+}
+
+// ripPlaylist 按专辑分组下载歌单曲目，再按歌单顺序写出 m3u8
+func ripPlaylist(task *Task) error {
+	root, playlistId, storefront := task.root(), task.PlaylistId, task.Storefront
+	name, tracks, err := getPlaylist(playlistId, storefront)
+	if err != nil {
+		fmt.Println("Failed to get playlist.")
+		return err
+	}
+	fmt.Printf("Playlist %s, %d tracks\n", name, len(tracks))
+
+	var failed bool
+	var albumIds []string
+	albumSongs := make(map[string][]string)
+	for _, track := range tracks {
+		if track.Type != "songs" {
+			continue
+		}
+		_, albumId, _ := checkUrl(track.Attributes.URL)
+		if albumId == "" {
+			albumId, err = getAlbumIdOfSong(track.ID, storefront)
+			if err != nil {
+				failed = true
+				fmt.Println("Failed to find album of", track.Attributes.Name, err)
+				task.Failures = append(task.Failures, TrackFailure{
+					ID:     track.ID,
+					Name:   track.Attributes.Name,
+					Reason: failureReason(err),
+					Error:  err.Error(),
+				})
+				continue
+			}
+		}
+		if _, ok := albumSongs[albumId]; !ok {
+			albumIds = append(albumIds, albumId)
+		}
+		albumSongs[albumId] = append(albumSongs[albumId], track.ID)
+	}
+
+	paths := make(map[string]string)
+	for _, albumId := range albumIds {
+		albumPaths, err := rip(task, albumId, albumSongs[albumId])
+		if err != nil {
+			failed = true
+			fmt.Println(err)
+		}
+		for id, p := range albumPaths {
+			paths[id] = p
+		}
+	}
+
+	err = writePlaylist(root, name, tracks, paths)
+	if err != nil {
+		fmt.Println("Failed to write playlist.")
+		return err
+	}
+	if failed {
+		return errors.New("some tracks failed to download")
+	}
+	return nil
+}
+
+// writePlaylist 在下载目录下写出 m3u8，路径相对于下载目录
+func writePlaylist(root string, name string, tracks []PlaylistTrack, paths map[string]string) error {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	for _, track := range tracks {
+		p, ok := paths[track.ID]
+		if !ok {
+			continue
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		b.WriteString(fmt.Sprintf("#EXTINF:%d,%s - %s\n", track.Attributes.DurationInMillis/1000, track.Attributes.ArtistName, track.Attributes.Name))
+		b.WriteString(filepath.ToSlash(rel) + "\n")
+	}
+	err := os.MkdirAll(root, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	playlistPath := filepath.Join(root, sanitizeName(name, config.MaxNameLength-len(".m3u8"))+".m3u8")
+	return ioutil.WriteFile(playlistPath, []byte(b.String()), 0644)
+}
+
+type ArtistAlbums struct {
+	Next string `json:"next"`
+	Data []struct {
+		ID         string          `json:"id"`
+		Type       string          `json:"type"`
+		Attributes AlbumAttributes `json:"attributes"`
+	} `json:"data"`
+}
+
+type ArtistFilter struct {
+	Types               []string `yaml:"types" json:"types"` // full-albums, singles, compilation-albums, live-albums
+	From                string   `yaml:"from" json:"from,omitempty"`
+	To                  string   `yaml:"to" json:"to,omitempty"`
+	ExcludeCompilations bool     `yaml:"exclude_compilations" json:"excludeCompilations"`
+}
+
+var artistViews = map[string]bool{"full-albums": true, "singles": true, "compilation-albums": true, "live-albums": true}
+
+// isArtistDate 接受 2006、2006-01 和 2006-01-02 三种格式，与 ReleaseDate 按字符串比较
+func isArtistDate(v string) bool {
+	for _, layout := range []string{"2006", "2006-01", "2006-01-02"} {
+		if _, err := time.Parse(layout, v); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// parseArtistFilter 用请求参数覆盖默认的艺人筛选条件
+func parseArtistFilter(query func(string) string, filter ArtistFilter) (ArtistFilter, error) {
+	var err error
+	if v := query("types"); v != "" {
+		filter.Types = strings.Split(v, ",")
+		for _, view := range filter.Types {
+			if !artistViews[view] {
+				return filter, fmt.Errorf("unknown type %q", view)
+			}
+		}
+	}
+	if v := query("from"); v != "" {
+		if !isArtistDate(v) {
+			return filter, fmt.Errorf("invalid from %q", v)
+		}
+		filter.From = v
+	}
+	if v := query("to"); v != "" {
+		if !isArtistDate(v) {
+			return filter, fmt.Errorf("invalid to %q", v)
+		}
+		filter.To = v
+	}
+	if v := query("exclude_compilations"); v != "" {
+		filter.ExcludeCompilations, err = strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid exclude_compilations %q", v)
+		}
+	}
+	return filter, nil
+}
+
+func (f *ArtistFilter) match(album AlbumAttributes) bool {
+	if f.ExcludeCompilations && album.IsCompilation {
+		return false
+	}
+	if f.From != "" && album.ReleaseDate < f.From {
+		return false
+	}
+	if f.To != "" && album.ReleaseDate > f.To && !strings.HasPrefix(album.ReleaseDate, f.To) {
+		return false
+	}
+	return true
+}
+
+// getArtistAlbums 按分类翻页列出艺人的专辑，按 UPC 去重
+func getArtistAlbums(artistId string, filter *ArtistFilter, storefront string) ([]Task, error) {
+	var tasks []Task
+	seen := make(map[string]bool)
+	for _, view := range filter.Types {
+		if filter.ExcludeCompilations && view == "compilation-albums" {
+			continue
+		}
+		query := url.Values{}
+		query.Set("limit", "100")
+		next := fmt.Sprintf("%s/v1/catalog/%s/artists/%s/view/%s", apiRoot, storefront, artistId, view)
+		for next != "" {
+			page := new(ArtistAlbums)
+			err := getApi(next, query, page)
+			if err != nil {
+				return nil, err
+			}
+			for _, album := range page.Data {
+				if !filter.match(album.Attributes) {
+					continue
+				}
+				key := album.Attributes.Upc
+				if key == "" {
+					key = album.ID
+				}
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				tasks = append(tasks, Task{
+					Url:        album.Attributes.URL,
+					AlbumId:    album.ID,
+					Storefront: storefront,
+				})
+			}
+			next = page.Next
+			query = nil
+		}
+	}
+	return tasks, nil
+}
+
+func getAlbumIdOfSong(songId string, storefront string) (string, error) {
+	song, err := getInfoFromAdam(songId, storefront)
+	if err != nil {
+		return "", err
+	}
+	if song == nil || len(song.Relationships.Albums.Data) == 0 {
+		return "", errors.New("album not found")
+	}
+	return song.Relationships.Albums.Data[0].ID, nil
+}
+
+func getToken() (string, error) {
+	req, err := http.NewRequest("GET", "https://beta.music.apple.com", nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	regex := regexp.MustCompile(`/assets/index-legacy-[^/]+\.js`)
+	indexJsUri := regex.FindString(string(body))
+
+	req, err = http.NewRequest("GET", "https://beta.music.apple.com"+indexJsUri, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	regex = regexp.MustCompile(`eyJh([^"]*)`)
+	token := regex.FindString(string(body))
+	if token == "" {
+		return "", errors.New("token not found")
+	}
+
+	return token, nil
+}
+
+const tokenRefreshMargin = time.Hour
+
+// jwtExpiry 解析 JWT 中的 exp
+func jwtExpiry(t string) (time.Time, error) {
+	parts := strings.Split(t, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("invalid token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, err
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, errors.New("token without exp")
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
+
+// getValidToken 返回当前 token，快过期时提前刷新，刷新失败但当前 token 还没过期时继续使用
+func getValidToken() (string, error) {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	if token != "" && time.Until(tokenExpiry) > tokenRefreshMargin {
+		return token, nil
+	}
+	t, err := updateToken("")
+	if err != nil {
+		if token != "" && time.Until(tokenExpiry) > 0 {
+			fmt.Println("Failed to refresh token, using current token until", tokenExpiry.Format(time.RFC3339), err)
+			return token, nil
+		}
+		return "", err
+	}
+	return t, nil
+}
+
+// refreshToken 在 stale 被服务器拒绝后刷新，其他请求已经刷新过时直接返回新的 token
+func refreshToken(stale string) (string, error) {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	if token != "" && token != stale {
+		return token, nil
+	}
+	return updateToken(stale)
+}
+
+// updateToken 依次尝试 config 中的 token、缓存文件和网页抓取，调用前需持有 tokenMu
+// 抓取失败时退回到快过期但还能用的 token
+func updateToken(rejected string) (string, error) {
+	var cached string
+	if b, err := ioutil.ReadFile(config.TokenCache); err == nil {
+		cached = strings.TrimSpace(string(b))
+	}
+	var usable string
+	var usableExp time.Time
+	for _, t := range []string{config.Token, cached} {
+		if t == "" || t == rejected {
+			continue
+		}
+		exp, err := jwtExpiry(t)
+		if err != nil || time.Until(exp) <= 0 {
+			continue
+		}
+		if time.Until(exp) <= tokenRefreshMargin {
+			if exp.After(usableExp) {
+				usable, usableExp = t, exp
+			}
+			continue
+		}
+		token, tokenExpiry = t, exp
+		return token, nil
+	}
+
+	t, err := getToken()
+	if err != nil {
+		if usable != "" {
+			fmt.Println("Failed to fetch token, using token expiring at", usableExp.Format(time.RFC3339), err)
+			token, tokenExpiry = usable, usableExp
+			return token, nil
+		}
+		return "", err
+	}
+	exp, err := jwtExpiry(t)
+	if err != nil {
+		return "", err
+	}
+	token, tokenExpiry = t, exp
+	fmt.Println("Token refreshed, expires at", exp.Format(time.RFC3339))
+	err = ioutil.WriteFile(config.TokenCache, []byte(t), 0600)
+	if err != nil {
+		fmt.Println("Failed to cache token.", err)
+	}
+	return token, nil
+}
+
+const (
+	apiRetries   = 4
+	maxRetryWait = time.Minute
+)
+
+var (
+	ErrNotFound     = errors.New("not found, removed or region-locked")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrServer       = errors.New("server error")
+	ErrUnavailable  = errors.New("unavailable in enhanced HLS")
+	ErrInvalidUrl   = errors.New("invalid url")
+)
+
+// ApiError amp-api 返回的非 200 响应，可以用 errors.Is 判断类型
+type ApiError struct {
+	StatusCode int
+	Status     string
+	URL        string
+}
+
+func newApiError(resp *http.Response) *ApiError {
+	return &ApiError{StatusCode: resp.StatusCode, Status: resp.Status, URL: resp.Request.URL.Path}
+}
+
+func (e *ApiError) Error() string {
+	if kind := e.Unwrap(); kind != nil {
+		return fmt.Sprintf("%s (%s %s)", kind, e.Status, e.URL)
+	}
+	return fmt.Sprintf("%s %s", e.Status, e.URL)
+}
+
+func (e *ApiError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		return ErrUnauthorized
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case e.StatusCode >= 500:
+		return ErrServer
+	}
+	return nil
+}
+
+// failureReason 将错误归类，写入任务报告
+func failureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return "not_found"
+	case errors.Is(err, ErrUnauthorized):
+		return "unauthorized"
+	case errors.Is(err, ErrRateLimited):
+		return "rate_limited"
+	case errors.Is(err, ErrServer):
+		return "server_error"
+	case errors.Is(err, ErrUnavailable):
+		return "unavailable"
+	}
+	return "error"
+}
+
+// retryWait 优先使用 Retry-After，否则按次数指数退避
+func retryWait(resp *http.Response, retries int) time.Duration {
+	wait := time.Second << retries
+	if resp != nil {
+		if v := resp.Header.Get("Retry-After"); v != "" {
+			if seconds, err := strconv.Atoi(v); err == nil {
+				wait = time.Duration(seconds) * time.Second
+			} else if t, err := http.ParseTime(v); err == nil {
+				wait = time.Until(t)
+			}
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > maxRetryWait {
+		wait = maxRetryWait
+	}
+	return wait
+}
+
+// doApi 带上 token 发送请求，401 且开发者 token 可能失效时刷新重试一次，429 和 5xx 按 Retry-After 重试
+func doApi(req *http.Request) (*http.Response, error) {
+	t, err := getValidToken()
+	if err != nil {
+		return nil, err
+	}
+	refreshed := false
+	retries := 0
+	for {
+		r := req.Clone(req.Context())
+		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t))
+		if config.MediaUserToken != "" {
+			// 带上账号 token 后目录接口按账号返回可用性，/v1/me 接口必须带
+			r.Header.Set("Media-User-Token", config.MediaUserToken)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			if retries >= apiRetries {
+				return nil, err
+			}
+			wait := retryWait(nil, retries)
+			fmt.Printf("%v, retrying in %s.\n", err, wait)
+			time.Sleep(wait)
+			retries++
+			continue
+		}
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized && !refreshed:
+			// 带 Media-User-Token 时 401 多半是账号 token 的问题，开发者 token 未临近过期就不重新抓取
+			if r.Header.Get("Media-User-Token") != "" {
+				if exp, err := jwtExpiry(t); err == nil && time.Until(exp) > tokenRefreshMargin {
+					resp.Body.Close()
+					return nil, newApiError(resp)
+				}
+			}
+			resp.Body.Close()
+			refreshed = true
+			fmt.Println("Token rejected, refreshing.")
+			t, err = refreshToken(t)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500) && retries < apiRetries:
+			resp.Body.Close()
+			wait := retryWait(resp, retries)
+			fmt.Printf("%s, retrying in %s.\n", resp.Status, wait)
+			time.Sleep(wait)
+			retries++
+			continue
+		}
+		return resp, nil
+	}
+}
+
+type ApiResult struct {
+	Data []SongData `json:"data"`
+}
+
+type SongAttributes struct {
+	ArtistName        string   `json:"artistName"`
+	DiscNumber        int      `json:"discNumber"`
+	GenreNames        []string `json:"genreNames"`
+	ExtendedAssetUrls struct {
+		EnhancedHls string `json:"enhancedHls"`
+	} `json:"extendedAssetUrls"`
+	IsMasteredForItunes bool   `json:"isMasteredForItunes"`
+	ReleaseDate         string `json:"releaseDate"`
+	Name                string `json:"name"`
+	Isrc                string `json:"isrc"`
+	AlbumName           string `json:"albumName"`
+	TrackNumber         int    `json:"trackNumber"`
+	ComposerName        string `json:"composerName"`
+}
+
+type AlbumAttributes struct {
+	ArtistName          string   `json:"artistName"`
+	IsSingle            bool     `json:"isSingle"`
+	IsComplete          bool     `json:"isComplete"`
+	GenreNames          []string `json:"genreNames"`
+	TrackCount          int      `json:"trackCount"`
+	IsMasteredForItunes bool     `json:"isMasteredForItunes"`
+	ReleaseDate         string   `json:"releaseDate"`
+	Name                string   `json:"name"`
+	RecordLabel         string   `json:"recordLabel"`
+	Upc                 string   `json:"upc"`
+	Copyright           string   `json:"copyright"`
+	IsCompilation       bool     `json:"isCompilation"`
+	URL                 string   `json:"url"`
+}
+
+type SongData struct {
+	ID            string         `json:"id"`
+	Attributes    SongAttributes `json:"attributes"`
+	Relationships struct {
+		Albums struct {
+			Data []struct {
+				ID         string          `json:"id"`
+				Type       string          `json:"type"`
+				Href       string          `json:"href"`
 				Attributes AlbumAttributes `json:"attributes"`
 			} `json:"data"`
 		} `json:"albums"`
@@ -597,6 +2213,12 @@ type Meta struct {
 	} `json:"byArtist"`
 }
 
+// EditorialNotes 专辑和艺人的编辑推荐语，内容带有 HTML 标签
+type EditorialNotes struct {
+	Standard string `json:"standard,omitempty"`
+	Short    string `json:"short,omitempty"`
+}
+
 type AutoGenerated struct {
 	Data []struct {
 		ID         string `json:"id"`
@@ -630,7 +2252,8 @@ type AutoGenerated struct {
 				ID   string `json:"id"`
 				Kind string `json:"kind"`
 			} `json:"playParams"`
-			IsCompilation bool `json:"isCompilation"`
+			IsCompilation  bool           `json:"isCompilation"`
+			EditorialNotes EditorialNotes `json:"editorialNotes"`
 		} `json:"attributes"`
 		Relationships struct {
 			RecordLabels struct {
@@ -644,69 +2267,76 @@ type AutoGenerated struct {
 					Type       string `json:"type"`
 					Href       string `json:"href"`
 					Attributes struct {
-						Name string `json:"name"`
+						Name           string         `json:"name"`
+						EditorialNotes EditorialNotes `json:"editorialNotes"`
 					} `json:"attributes"`
 				} `json:"data"`
 			} `json:"artists"`
-			Tracks struct {
-				Href string `json:"href"`
-				Data []struct {
-					ID         string `json:"id"`
-					Type       string `json:"type"`
-					Href       string `json:"href"`
-					Attributes struct {
-						Previews []struct {
-							URL string `json:"url"`
-						} `json:"previews"`
-						Artwork struct {
-							Width      int    `json:"width"`
-							Height     int    `json:"height"`
-							URL        string `json:"url"`
-							BgColor    string `json:"bgColor"`
-							TextColor1 string `json:"textColor1"`
-							TextColor2 string `json:"textColor2"`
-							TextColor3 string `json:"textColor3"`
-							TextColor4 string `json:"textColor4"`
-						} `json:"artwork"`
-						ArtistName          string   `json:"artistName"`
-						URL                 string   `json:"url"`
-						DiscNumber          int      `json:"discNumber"`
-						GenreNames          []string `json:"genreNames"`
-						HasTimeSyncedLyrics bool     `json:"hasTimeSyncedLyrics"`
-						IsMasteredForItunes bool     `json:"isMasteredForItunes"`
-						DurationInMillis    int      `json:"durationInMillis"`
-						ReleaseDate         string   `json:"releaseDate"`
-						Name                string   `json:"name"`
-						Isrc                string   `json:"isrc"`
-						AudioTraits         []string `json:"audioTraits"`
-						HasLyrics           bool     `json:"hasLyrics"`
-						AlbumName           string   `json:"albumName"`
-						PlayParams          struct {
-							ID   string `json:"id"`
-							Kind string `json:"kind"`
-						} `json:"playParams"`
-						TrackNumber  int    `json:"trackNumber"`
-						AudioLocale  string `json:"audioLocale"`
-						ComposerName string `json:"composerName"`
-					} `json:"attributes"`
-					Relationships struct {
-						Artists struct {
-							Href string `json:"href"`
-							Data []struct {
-								ID         string `json:"id"`
-								Type       string `json:"type"`
-								Href       string `json:"href"`
-								Attributes struct {
-									Name string `json:"name"`
-								} `json:"attributes"`
-							} `json:"data"`
-						} `json:"artists"`
-					} `json:"relationships"`
-				} `json:"data"`
-			} `json:"tracks"`
+			Tracks AlbumTracks `json:"tracks"`
 		} `json:"relationships"`
 	} `json:"data"`
 }
+type AlbumTrack struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Href       string `json:"href"`
+	Attributes struct {
+		Previews []struct {
+			URL string `json:"url"`
+		} `json:"previews"`
+		Artwork struct {
+			Width      int    `json:"width"`
+			Height     int    `json:"height"`
+			URL        string `json:"url"`
+			BgColor    string `json:"bgColor"`
+			TextColor1 string `json:"textColor1"`
+			TextColor2 string `json:"textColor2"`
+			TextColor3 string `json:"textColor3"`
+			TextColor4 string `json:"textColor4"`
+		} `json:"artwork"`
+		ArtistName          string   `json:"artistName"`
+		URL                 string   `json:"url"`
+		DiscNumber          int      `json:"discNumber"`
+		GenreNames          []string `json:"genreNames"`
+		HasTimeSyncedLyrics bool     `json:"hasTimeSyncedLyrics"`
+		IsMasteredForItunes bool     `json:"isMasteredForItunes"`
+		DurationInMillis    int      `json:"durationInMillis"`
+		ReleaseDate         string   `json:"releaseDate"`
+		Name                string   `json:"name"`
+		Isrc                string   `json:"isrc"`
+		AudioTraits         []string `json:"audioTraits"`
+		HasLyrics           bool     `json:"hasLyrics"`
+		AlbumName           string   `json:"albumName"`
+		PlayParams          struct {
+			ID   string `json:"id"`
+			Kind string `json:"kind"`
+		} `json:"playParams"`
+		TrackNumber   int    `json:"trackNumber"`
+		AudioLocale   string `json:"audioLocale"`
+		ComposerName  string `json:"composerName"`
+		ContentRating string `json:"contentRating"`
+	} `json:"attributes"`
+	Relationships struct {
+		Artists struct {
+			Href string `json:"href"`
+			Data []struct {
+				ID         string `json:"id"`
+				Type       string `json:"type"`
+				Href       string `json:"href"`
+				Attributes struct {
+					Name string `json:"name"`
+				} `json:"attributes"`
+			} `json:"data"`
+		} `json:"artists"`
+	} `json:"relationships"`
+}
+
+type AlbumTracks struct {
+	Href string       `json:"href"`
+	Next string       `json:"next"`
+	Data []AlbumTrack `json:"data"`
+}
+
 type SampleInfo struct {
 	data      []byte
 	duration  uint32
@@ -715,8 +2345,17 @@ type SampleInfo struct {
 
 type SongInfo struct {
 	r         io.ReadSeeker
-	alacParam *Alac
+	alacParam *Alac // 仅 alac
 	samples   []SampleInfo
+
+	format      mp4.BoxType           // 解密后的 sample entry 类型
+	sampleEntry *mp4.BoxInfo          // 源文件中的 enca
+	entryParam  *mp4.AudioSampleEntry // 源文件 enca 的参数
+
+	movieTimescale uint32 // mvhd
+	timescale      uint32 // mdhd
+	priming        uint32 // 编码延迟
+	remainder      uint32 // 末尾填充
 }
 
 func BoxTypeAlac() mp4.BoxType { return mp4.StrToBoxType("alac") }
@@ -747,10 +2386,173 @@ func (s *SongInfo) Duration() (ret uint64) {
 	return
 }
 
+// readGapless 从源文件的 mvhd、mdhd、elst 和 mehd 计算编码延迟与末尾填充
+func (s *SongInfo) readGapless() error {
+	mvhd, err := mp4.ExtractBoxWithPayload(s.r, nil, mp4.BoxPath{mp4.BoxTypeMoov(), mp4.BoxTypeMvhd()})
+	if err != nil {
+		return err
+	}
+	if len(mvhd) != 1 {
+		return errors.New("mvhd not found")
+	}
+	s.movieTimescale = mvhd[0].Payload.(*mp4.Mvhd).Timescale
+
+	mdhd, err := mp4.ExtractBoxWithPayload(s.r, nil, mp4.BoxPath{
+		mp4.BoxTypeMoov(),
+		mp4.BoxTypeTrak(),
+		mp4.BoxTypeMdia(),
+		mp4.BoxTypeMdhd(),
+	})
+	if err != nil {
+		return err
+	}
+	if len(mdhd) != 1 {
+		return errors.New("mdhd not found")
+	}
+	s.timescale = mdhd[0].Payload.(*mp4.Mdhd).Timescale
+	if s.movieTimescale == 0 {
+		s.movieTimescale = s.timescale
+	}
+
+	elst, err := mp4.ExtractBoxWithPayload(s.r, nil, mp4.BoxPath{
+		mp4.BoxTypeMoov(),
+		mp4.BoxTypeTrak(),
+		mp4.BoxTypeEdts(),
+		mp4.BoxTypeElst(),
+	})
+	if err != nil {
+		return err
+	}
+
+	total := s.Duration()
+	var valid uint64
+	if len(elst) != 0 {
+		e := elst[0].Payload.(*mp4.Elst)
+		for _, entry := range e.Entries {
+			mediaTime, segment := int64(entry.MediaTimeV0), uint64(entry.SegmentDurationV0)
+			if e.Version == 1 {
+				mediaTime, segment = entry.MediaTimeV1, entry.SegmentDurationV1
+			}
+			if mediaTime < 0 { // empty edit
+				continue
+			}
+			s.priming = uint32(mediaTime)
+			valid = segment * uint64(s.timescale) / uint64(s.movieTimescale)
+			break
+		}
+	}
+	if uint64(s.priming) > total {
+		s.priming = 0
+	}
+	// 分片文件的 segment_duration 通常为 0，改用 mehd 中整个影片的时长
+	if valid == 0 {
+		mehd, err := mp4.ExtractBoxWithPayload(s.r, nil, mp4.BoxPath{
+			mp4.BoxTypeMoov(),
+			mp4.BoxTypeMvex(),
+			mp4.BoxTypeMehd(),
+		})
+		if err != nil {
+			return err
+		}
+		if len(mehd) != 0 {
+			m := mehd[0].Payload.(*mp4.Mehd)
+			duration := uint64(m.FragmentDurationV0)
+			if m.Version == 1 {
+				duration = m.FragmentDurationV1
+			}
+			valid = duration * uint64(s.timescale) / uint64(s.movieTimescale)
+		}
+	}
+	// 都没有时只去掉编码延迟，不处理末尾填充
+	if valid == 0 || uint64(s.priming)+valid > total {
+		valid = total - uint64(s.priming)
+	}
+	s.remainder = uint32(total - uint64(s.priming) - valid)
+	return nil
+}
+
+// ValidDuration 去掉编码延迟和填充后的时长，单位为 mdhd timescale
+func (s *SongInfo) ValidDuration() uint64 {
+	return s.Duration() - uint64(s.priming) - uint64(s.remainder)
+}
+
+// MovieDuration 换算到 mvhd timescale 的有效时长
+func (s *SongInfo) MovieDuration() uint64 {
+	if s.timescale == 0 {
+		return s.ValidDuration()
+	}
+	return s.ValidDuration() * uint64(s.movieTimescale) / uint64(s.timescale)
+}
+
+// iTunSMPB 格式: 0, 编码延迟, 末尾填充, 有效采样数, 其余补 0
+func (s *SongInfo) iTunSMPB() string {
+	smpb := fmt.Sprintf(" %08X %08X %08X %016X", 0, s.priming, s.remainder, s.ValidDuration())
+	for i := 0; i < 8; i++ {
+		smpb += " 00000000"
+	}
+	return smpb
+}
+
 func (*Alac) GetType() mp4.BoxType {
 	return BoxTypeAlac()
 }
 
+// formatName 按模板生成相对路径，{name:N} 表示补零到 N 位，
+// 模板中的 / 会生成子目录，每一级单独清理，空的一级替换为 _，reserve 为最后一级需要为扩展名预留的长度
+func formatName(template string, fields map[string]string, reserve int) string {
+	parts := strings.Split(template, "/")
+	var names []string
+	for i, part := range parts {
+		name := templateField.ReplaceAllStringFunc(part, func(m string) string {
+			sub := templateField.FindStringSubmatch(m)
+			v, ok := fields[sub[1]]
+			if !ok {
+				return m
+			}
+			if sub[2] != "" {
+				width, _ := strconv.Atoi(sub[2])
+				if n, err := strconv.Atoi(v); err == nil {
+					return fmt.Sprintf("%0*d", width, n)
+				}
+			}
+			return v
+		})
+		maxLength := config.MaxNameLength
+		if i == len(parts)-1 {
+			maxLength -= reserve
+		}
+		names = append(names, sanitizeName(name, maxLength))
+	}
+	return filepath.Join(names...)
+}
+
+// sanitizeName 按配置的文件系统替换非法字符，并按字节数截断，
+// 空名以及 . 和 .. 替换为 _，避免元数据生成的路径跳出下载目录
+func sanitizeName(name string, maxLength int) string {
+	forbidden, ok := forbiddenNames[config.Sanitize]
+	if !ok {
+		forbidden = forbiddenNames["windows"]
+	}
+	name = strings.TrimSpace(forbidden.ReplaceAllString(name, "_"))
+	if maxLength > 0 && len(name) > maxLength {
+		cut := maxLength
+		for cut > 0 && !utf8.RuneStart(name[cut]) {
+			cut--
+		}
+		name = strings.TrimSpace(name[:cut])
+	}
+	if config.Sanitize == "windows" || !ok {
+		name = strings.TrimRight(name, ". ")
+		if windowsReservedNames.MatchString(name) {
+			name = "_" + name
+		}
+	}
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	return name
+}
+
 func fileExists(path string) (bool, error) {
 	f, err := os.Stat(path)
 	if err == nil {
@@ -761,8 +2563,9 @@ func fileExists(path string) (bool, error) {
 	return false, err
 }
 
-func writeM4a(w *mp4.Writer, info *SongInfo, meta *AutoGenerated, data []byte, trackNum, trackTotal int) error {
-	index := trackNum - 1
+// writeM4a 写入解密后的曲目，标签取自 track 和 track.Album，trkn 使用碟内编号
+func writeM4a(w *mp4.Writer, info *SongInfo, track *Track, data []byte, cover []byte, lyrics string) error {
+	album := track.Album
 	{ // ftyp
 		box, err := w.StartBox(&mp4.BoxInfo{Type: mp4.BoxTypeFtyp()})
 		if err != nil {
@@ -789,9 +2592,41 @@ func writeM4a(w *mp4.Writer, info *SongInfo, meta *AutoGenerated, data []byte, t
 
 	const chunkSize uint32 = 5
 	duration := info.Duration()
+	movieDuration := info.MovieDuration()
 	numSamples := uint32(len(info.samples))
 	var stco *mp4.BoxInfo
 
+	// copyRest 在 faithful_remux 模式下复制源 box 中没有重建的子 box，加密相关的丢弃
+	copyRest := func(parent *mp4.BoxInfo, rebuilt ...mp4.BoxType) error {
+		if !config.FaithfulRemux {
+			return nil
+		}
+		children, err := mp4.ExtractBox(info.r, parent, mp4.BoxPath{mp4.BoxTypeAny()})
+		if err != nil {
+			return err
+		}
+	next:
+		for _, child := range children {
+			for _, t := range rebuilt {
+				if child.Type == t {
+					continue next
+				}
+			}
+			drm, err := isDrmBox(info.r, child)
+			if err != nil {
+				return err
+			}
+			if drm {
+				continue
+			}
+			err = w.CopyBox(info.r, child)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	{ // moov
 		_, err := w.StartBox(&mp4.BoxInfo{Type: mp4.BoxTypeMoov()})
 		if err != nil {
@@ -815,9 +2650,9 @@ func writeM4a(w *mp4.Writer, info *SongInfo, meta *AutoGenerated, data []byte, t
 			}
 			mvhd := oriBox[0].Payload.(*mp4.Mvhd)
 			if mvhd.Version == 0 {
-				mvhd.DurationV0 = uint32(duration)
+				mvhd.DurationV0 = uint32(movieDuration)
 			} else {
-				mvhd.DurationV1 = duration
+				mvhd.DurationV1 = movieDuration
 			}
 
 			_, err = mp4.Marshal(w, mvhd, oriBox[0].Info.Context)
@@ -855,9 +2690,9 @@ func writeM4a(w *mp4.Writer, info *SongInfo, meta *AutoGenerated, data []byte, t
 				}
 				tkhd := oriBox[0].Payload.(*mp4.Tkhd)
 				if tkhd.Version == 0 {
-					tkhd.DurationV0 = uint32(duration)
+					tkhd.DurationV0 = uint32(movieDuration)
 				} else {
-					tkhd.DurationV1 = duration
+					tkhd.DurationV1 = movieDuration
 				}
 				tkhd.SetFlags(0x7)
 
@@ -872,6 +2707,48 @@ func writeM4a(w *mp4.Writer, info *SongInfo, meta *AutoGenerated, data []byte, t
 				}
 			}
 
+			{ // edts
+				_, err = w.StartBox(&mp4.BoxInfo{Type: mp4.BoxTypeEdts()})
+				if err != nil {
+					return err
+				}
+
+				box, err := w.StartBox(&mp4.BoxInfo{Type: mp4.BoxTypeElst()})
+				if err != nil {
+					return err
+				}
+
+				elst := mp4.Elst{EntryCount: 1}
+				if movieDuration > math.MaxUint32 || info.priming > math.MaxInt32 {
+					elst.SetVersion(1)
+					elst.Entries = []mp4.ElstEntry{{
+						SegmentDurationV1: movieDuration,
+						MediaTimeV1:       int64(info.priming),
+						MediaRateInteger:  1,
+					}}
+				} else {
+					elst.Entries = []mp4.ElstEntry{{
+						SegmentDurationV0: uint32(movieDuration),
+						MediaTimeV0:       int32(info.priming),
+						MediaRateInteger:  1,
+					}}
+				}
+				_, err = mp4.Marshal(w, &elst, box.Context)
+				if err != nil {
+					return err
+				}
+
+				_, err = w.EndBox()
+				if err != nil {
+					return err
+				}
+
+				_, err = w.EndBox()
+				if err != nil {
+					return err
+				}
+			}
+
 			{ // mdia
 				_, err = w.StartBox(&mp4.BoxInfo{Type: mp4.BoxTypeMdia()})
 				if err != nil {
@@ -959,6 +2836,12 @@ func writeM4a(w *mp4.Writer, info *SongInfo, meta *AutoGenerated, data []byte, t
 							return err
 						}
 
+						box, err := mp4.ExtractBox(info.r, minfOri, mp4.BoxPath{mp4.BoxTypeStbl()})
+						if err != nil {
+							return err
+						}
+						stblOri := box[0]
+
 						{ // stsd
 							box, err := w.StartBox(&mp4.BoxInfo{Type: mp4.BoxTypeStsd()})
 							if err != nil {
@@ -969,7 +2852,12 @@ func writeM4a(w *mp4.Writer, info *SongInfo, meta *AutoGenerated, data []byte, t
 								return err
 							}
 
-							{ // alac
+							if info.alacParam == nil { // mp4a, ec-3
+								err = writeSampleEntry(w, info)
+								if err != nil {
+									return err
+								}
+							} else { // alac
 								_, err = w.StartBox(&mp4.BoxInfo{Type: BoxTypeAlac()})
 								if err != nil {
 									return err
@@ -1147,30 +3035,56 @@ func writeM4a(w *mp4.Writer, info *SongInfo, meta *AutoGenerated, data []byte, t
 							}
 						}
 
+						err = copyRest(stblOri, mp4.BoxTypeStsd(), mp4.BoxTypeStts(), mp4.BoxTypeStsc(),
+							mp4.BoxTypeStsz(), mp4.StrToBoxType("stz2"), mp4.BoxTypeStco(), mp4.BoxTypeCo64())
+						if err != nil {
+							return err
+						}
+
 						_, err = w.EndBox()
 						if err != nil {
 							return err
 						}
 					}
 
+					err = copyRest(minfOri, mp4.BoxTypeSmhd(), mp4.BoxTypeDinf(), mp4.BoxTypeStbl())
+					if err != nil {
+						return err
+					}
+
 					_, err = w.EndBox()
 					if err != nil {
 						return err
 					}
 				}
 
+				err = copyRest(mdiaOri, mp4.BoxTypeMdhd(), mp4.BoxTypeHdlr(), mp4.BoxTypeMinf())
+				if err != nil {
+					return err
+				}
+
 				_, err = w.EndBox()
 				if err != nil {
 					return err
 				}
 			}
 
+			err = copyRest(trakOri, mp4.BoxTypeTkhd(), mp4.BoxTypeEdts(), mp4.BoxTypeMdia())
+			if err != nil {
+				return err
+			}
+
 			_, err = w.EndBox()
 			if err != nil {
 				return err
 			}
 		}
 
+		err = copyRest(moovOri, mp4.BoxTypeMvhd(), mp4.BoxTypeTrak(), mp4.BoxTypeUdta())
+		if err != nil {
+			return err
+		}
+
 		{ // udta
 			ctx := mp4.Context{UnderUdta: true}
 			_, err := w.StartBox(&mp4.BoxInfo{Type: mp4.BoxTypeUdta(), Context: ctx})
@@ -1178,6 +3092,17 @@ func writeM4a(w *mp4.Writer, info *SongInfo, meta *AutoGenerated, data []byte, t
 				return err
 			}
 
+			udtaOri, err := mp4.ExtractBox(info.r, moovOri, mp4.BoxPath{mp4.BoxTypeUdta()})
+			if err != nil {
+				return err
+			}
+			if len(udtaOri) != 0 {
+				err = copyRest(udtaOri[0], mp4.BoxTypeMeta())
+				if err != nil {
+					return err
+				}
+			}
+
 			{ // meta
 				ctx.UnderIlstMeta = true
 
@@ -1237,9 +3162,15 @@ func writeM4a(w *mp4.Writer, info *SongInfo, meta *AutoGenerated, data []byte, t
 							boxData.DataType = mp4.DataTypeSignedIntBigEndian
 							boxData.Data = make([]byte, 4)
 							binary.BigEndian.PutUint32(boxData.Data, v)
+						case uint64:
+							boxData.DataType = mp4.DataTypeSignedIntBigEndian
+							boxData.Data = make([]byte, 8)
+							binary.BigEndian.PutUint64(boxData.Data, v)
 						case []byte:
 							boxData.DataType = mp4.DataTypeBinary
 							boxData.Data = v
+						case *mp4.Data:
+							boxData = *v
 						default:
 							panic("unsupported value")
 						}
@@ -1331,123 +3262,208 @@ func writeM4a(w *mp4.Writer, info *SongInfo, meta *AutoGenerated, data []byte, t
 						return err
 					}
 
-					err = addMeta(mp4.BoxType{'\251', 'n', 'a', 'm'}, meta.Data[0].Relationships.Tracks.Data[index].Attributes.Name)
+					err = addMeta(mp4.BoxType{'\251', 'n', 'a', 'm'}, track.Name)
 					if err != nil {
 						return err
 					}
 
-					err = addMeta(mp4.BoxType{'\251', 'a', 'l', 'b'}, meta.Data[0].Attributes.Name)
+					err = addMeta(mp4.BoxType{'\251', 'a', 'l', 'b'}, album.Name)
 					if err != nil {
 						return err
 					}
 
-					err = addMeta(mp4.BoxType{'\251', 'A', 'R', 'T'}, meta.Data[0].Relationships.Tracks.Data[index].Attributes.ArtistName)
+					err = addMeta(mp4.BoxType{'\251', 'A', 'R', 'T'}, track.ArtistName)
 					if err != nil {
 						return err
 					}
 
-					err = addMeta(mp4.BoxType{'\251', 'w', 'r', 't'}, meta.Data[0].Relationships.Tracks.Data[index].Attributes.ComposerName)
+					err = addMeta(mp4.BoxType{'\251', 'w', 'r', 't'}, track.ComposerName)
 					if err != nil {
 						return err
 					}
 
-					err = addMeta(mp4.BoxType{'\251', 'd', 'a', 'y'}, strings.Split(meta.Data[0].Attributes.ReleaseDate, "-")[0])
+					err = addMeta(mp4.BoxType{'\251', 'd', 'a', 'y'}, album.Year)
 					if err != nil {
 						return err
 					}
 
-					// cnID, err := strconv.ParseUint(meta.Data[0].Relationships.Tracks.Data[index].ID, 10, 32)
-					// if err != nil {
-					// 	return err
-					// }
-
-					// err = addMeta(mp4.BoxType{'c', 'n', 'I', 'D'}, uint32(cnID))
-					// if err != nil {
-					// 	return err
-					// }
-
-					err = addExtendedMeta("ISRC", meta.Data[0].Relationships.Tracks.Data[index].Attributes.Isrc)
-					if err != nil {
-						return err
+					// 只在有真正的排序值时写入排序字段，与显示名相同时交给播放器自己排序
+					var sortTitle, sortArtist, sortAlbum, sortAlbumArtist string
+					if track.AltName != "" {
+						switch config.SecondaryLanguageMode {
+						case "sort":
+							sortTitle, sortArtist, sortAlbum, sortAlbumArtist = track.AltName, track.AltArtistName, album.AltName, album.AltArtistName
+						case "original":
+							if track.AltName != track.Name {
+								err = addExtendedMeta("ORIGINALTITLE", track.AltName)
+								if err != nil {
+									return err
+								}
+							}
+							if album.AltName != album.Name {
+								err = addExtendedMeta("ORIGINALALBUM", album.AltName)
+								if err != nil {
+									return err
+								}
+							}
+						}
 					}
 
-					if len(meta.Data[0].Relationships.Tracks.Data[index].Attributes.GenreNames) > 0 {
-						err = addMeta(mp4.BoxType{'\251', 'g', 'e', 'n'}, meta.Data[0].Relationships.Tracks.Data[index].Attributes.GenreNames[0])
+					sorts := []struct {
+						tag     mp4.BoxType
+						value   string
+						display string
+					}{
+						{mp4.BoxType{'s', 'o', 'n', 'm'}, sortTitle, track.Name},
+						{mp4.BoxType{'s', 'o', 'a', 'l'}, sortAlbum, album.Name},
+						{mp4.BoxType{'s', 'o', 'a', 'r'}, sortArtist, track.ArtistName},
+						{mp4.BoxType{'s', 'o', 'a', 'a'}, sortAlbumArtist, album.ArtistName},
+					}
+					for _, field := range sorts {
+						if field.value == "" || field.value == field.display {
+							continue
+						}
+						err = addMeta(field.tag, field.value)
 						if err != nil {
 							return err
 						}
 					}
 
-					if len(meta.Data) > 0 {
-						album := meta.Data[0]
-
-						err = addMeta(mp4.BoxType{'a', 'A', 'R', 'T'}, album.Attributes.ArtistName)
+					// ID 超出 32 位时 iTunes 也无法识别，直接跳过
+					cnID, err := strconv.ParseUint(track.ID, 10, 32)
+					if err == nil {
+						err = addMeta(mp4.BoxType{'c', 'n', 'I', 'D'}, uint32(cnID))
 						if err != nil {
 							return err
 						}
+					}
 
-						err = addMeta(mp4.BoxType{'c', 'p', 'r', 't'}, album.Attributes.Copyright)
+					atID, err := strconv.ParseUint(track.ArtistID, 10, 32)
+					if err == nil {
+						err = addMeta(mp4.BoxType{'a', 't', 'I', 'D'}, uint32(atID))
 						if err != nil {
 							return err
 						}
+					}
 
-						var isCpil uint8
-						if album.Attributes.IsCompilation {
-							isCpil = 1
-						}
-						err = addMeta(mp4.BoxType{'c', 'p', 'i', 'l'}, isCpil)
+					var rtng uint8
+					switch track.ContentRating {
+					case "explicit":
+						rtng = 1
+					case "clean":
+						rtng = 2
+					}
+					err = addMeta(mp4.BoxType{'r', 't', 'n', 'g'}, rtng)
+					if err != nil {
+						return err
+					}
+
+					err = addExtendedMeta("iTunSMPB", info.iTunSMPB())
+					if err != nil {
+						return err
+					}
+
+					err = addExtendedMeta("ISRC", track.Isrc)
+					if err != nil {
+						return err
+					}
+
+					if len(track.GenreNames) > 0 {
+						err = addMeta(mp4.BoxType{'\251', 'g', 'e', 'n'}, track.GenreNames[0])
 						if err != nil {
 							return err
 						}
+					}
+
+					err = addMeta(mp4.BoxType{'a', 'A', 'R', 'T'}, album.ArtistName)
+					if err != nil {
+						return err
+					}
+
+					err = addMeta(mp4.BoxType{'c', 'p', 'r', 't'}, album.Copyright)
+					if err != nil {
+						return err
+					}
+
+					var isCpil uint8
+					if album.IsCompilation {
+						isCpil = 1
+					}
+					err = addMeta(mp4.BoxType{'c', 'p', 'i', 'l'}, isCpil)
+					if err != nil {
+						return err
+					}
+
+					err = addExtendedMeta("LABEL", album.RecordLabel)
+					if err != nil {
+						return err
+					}
+
+					err = addExtendedMeta("UPC", album.Upc)
+					if err != nil {
+						return err
+					}
 
-						err = addExtendedMeta("LABEL", album.Attributes.RecordLabel)
+					for _, tag := range creditTags(track.Credits) {
+						err = addExtendedMeta(tag.Name, tag.Value)
 						if err != nil {
 							return err
 						}
+					}
 
-						err = addExtendedMeta("UPC", album.Attributes.Upc)
+					plID, err := strconv.ParseUint(album.ID, 10, 64)
+					if err == nil {
+						err = addMeta(mp4.BoxType{'p', 'l', 'I', 'D'}, plID)
 						if err != nil {
 							return err
 						}
+					}
 
-						// plID, err := strconv.ParseUint(album.ID, 10, 32)
-						// if err != nil {
-						// 	return err
-						// }
+					trkn := make([]byte, 8)
+					binary.BigEndian.PutUint32(trkn, uint32(track.TrackNumber))
+					binary.BigEndian.PutUint16(trkn[4:], uint16(track.DiscTrackTotal))
+					err = addMeta(mp4.BoxType{'t', 'r', 'k', 'n'}, trkn)
+					if err != nil {
+						return err
+					}
 
-						// err = addMeta(mp4.BoxType{'p', 'l', 'I', 'D'}, uint32(plID))
-						// if err != nil {
-						// 	return err
-						// }
+					if config.EmbedDescription {
+						if desc := shortDescription(album.EditorialNotes); desc != "" {
+							err = addMeta(mp4.BoxType{'d', 'e', 's', 'c'}, desc)
+							if err != nil {
+								return err
+							}
+						}
+						if ldes := notesText(album.EditorialNotes.Standard); ldes != "" {
+							err = addMeta(mp4.BoxType{'l', 'd', 'e', 's'}, ldes)
+							if err != nil {
+								return err
+							}
+						}
 					}
 
-					// if len(meta.Data[0].Relationships.Artists.Data) > 0 {
-					// 	atID, err := strconv.ParseUint(meta.Data[0].Relationships.Artists.Data[index].ID, 10, 32)
-					// 	if err != nil {
-					// 		return err
-					// 	}
+					if lyrics != "" {
+						err = addMeta(mp4.BoxType{'\251', 'l', 'y', 'r'}, lyrics)
+						if err != nil {
+							return err
+						}
+					}
 
-					// 	err = addMeta(mp4.BoxType{'a', 't', 'I', 'D'}, uint32(atID))
-					// 	if err != nil {
-					// 		return err
-					// 	}
-					// }
+					if config.EmbedCover && len(cover) > 0 {
+						err = addMeta(mp4.BoxType{'c', 'o', 'v', 'r'}, &mp4.Data{DataType: coverDataType(cover), Data: cover})
+						if err != nil {
+							return err
+						}
+					}
 
-					trkn := make([]byte, 8)
-					binary.BigEndian.PutUint32(trkn, uint32(trackNum))
-					binary.BigEndian.PutUint16(trkn[4:], uint16(trackTotal))
-					err = addMeta(mp4.BoxType{'t', 'r', 'k', 'n'}, trkn)
+					disk := make([]byte, 6)
+					binary.BigEndian.PutUint32(disk, uint32(track.DiscNumber))
+					binary.BigEndian.PutUint16(disk[4:], uint16(album.DiscTotal))
+					err = addMeta(mp4.BoxType{'d', 'i', 's', 'k'}, disk)
 					if err != nil {
 						return err
 					}
 
-					// disk := make([]byte, 8)
-					// binary.BigEndian.PutUint32(disk, uint32(meta.Attributes.DiscNumber))
-					// err = addMeta(mp4.BoxType{'d', 'i', 's', 'k'}, disk)
-					// if err != nil {
-					// 	return err
-					// }
-
 					ctx.UnderIlst = false
 
 					_, err = w.EndBox()
@@ -1513,7 +3529,147 @@ func writeM4a(w *mp4.Writer, info *SongInfo, meta *AutoGenerated, data []byte, t
 	return nil
 }
 
-func decryptSong(info *SongInfo, keys []string, manifest *AutoGenerated, filename string, trackNum, trackTotal int) error {
+var drmBoxTypes = []mp4.BoxType{
+	mp4.BoxTypePssh(),
+	mp4.BoxTypeSinf(),
+	mp4.BoxTypeTenc(),
+	mp4.BoxTypeSaio(),
+	mp4.BoxTypeSaiz(),
+	mp4.StrToBoxType("senc"),
+	mp4.BoxTypeMvex(), // 只对分片文件有效
+}
+
+// isDrmBox 判断 box 是否只和加密或分片有关，seig 类型的 sgpd/sbgp 也算
+func isDrmBox(r io.ReadSeeker, bi *mp4.BoxInfo) (bool, error) {
+	for _, t := range drmBoxTypes {
+		if bi.Type == t {
+			return true, nil
+		}
+	}
+	if bi.Type != mp4.BoxTypeSgpd() && bi.Type != mp4.BoxTypeSbgp() {
+		return false, nil
+	}
+	_, err := bi.SeekToPayload(r)
+	if err != nil {
+		return false, err
+	}
+	header := make([]byte, 8)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return false, err
+	}
+	return string(header[4:]) == "seig", nil
+}
+
+var containerBoxTypes = []mp4.BoxType{
+	mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeEdts(), mp4.BoxTypeMdia(),
+	mp4.BoxTypeMinf(), mp4.BoxTypeDinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(),
+	mp4.BoxTypeMvex(), mp4.BoxTypeUdta(), mp4.BoxTypeMeta(), mp4.BoxTypeIlst(),
+	mp4.BoxTypeEnca(), mp4.BoxTypeMp4a(), mp4.BoxTypeSinf(), mp4.BoxTypeSchi(),
+}
+
+// moovBoxPaths 统计 moov 下每条 box 路径出现的次数
+func moovBoxPaths(r io.ReadSeeker) (map[string]int, error) {
+	_, err := r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	paths := make(map[string]int)
+	_, err = mp4.ReadBoxStructure(r, func(h *mp4.ReadHandle) (interface{}, error) {
+		if h.Path[0] != mp4.BoxTypeMoov() {
+			return nil, nil
+		}
+		var names []string
+		for _, t := range h.Path {
+			names = append(names, t.String())
+		}
+		paths[strings.Join(names, "/")]++
+		for _, t := range containerBoxTypes {
+			if h.BoxInfo.Type == t {
+				return h.Expand()
+			}
+		}
+		return nil, nil
+	})
+	return paths, err
+}
+
+// printBoxDiff 打印源文件和输出文件 moov 结构的差异
+func printBoxDiff(src, dst io.ReadSeeker) error {
+	srcPaths, err := moovBoxPaths(src)
+	if err != nil {
+		return err
+	}
+	dstPaths, err := moovBoxPaths(dst)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for p, n := range srcPaths {
+		if dstPaths[p] < n {
+			lines = append(lines, fmt.Sprintf("- %s (%d)", p, n-dstPaths[p]))
+		}
+	}
+	for p, n := range dstPaths {
+		if srcPaths[p] < n {
+			lines = append(lines, fmt.Sprintf("+ %s (%d)", p, n-srcPaths[p]))
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i][2:] < lines[j][2:]
+	})
+	fmt.Println("Box diff:")
+	for _, l := range lines {
+		fmt.Println(l)
+	}
+	return nil
+}
+
+// writeSampleEntry 将源文件的 enca 改写回原始格式，复制除 sinf 外的子 box (esds、dec3 等)
+func writeSampleEntry(w *mp4.Writer, info *SongInfo) error {
+	_, err := w.StartBox(&mp4.BoxInfo{Type: info.format})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write([]byte{
+		0, 0, 0, 0, 0, 0, 0, 1,
+		0, 0, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		return err
+	}
+
+	for _, v := range []uint16{info.entryParam.ChannelCount, info.entryParam.SampleSize, 0, 0} {
+		err = binary.Write(w, binary.BigEndian, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = binary.Write(w, binary.BigEndian, info.entryParam.SampleRate)
+	if err != nil {
+		return err
+	}
+
+	children, err := mp4.ExtractBox(info.r, info.sampleEntry, mp4.BoxPath{mp4.BoxTypeAny()})
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if child.Type == mp4.BoxTypeSinf() {
+			continue
+		}
+		err = w.CopyBox(info.r, child)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = w.EndBox()
+	return err
+}
+
+func decryptSong(info *SongInfo, adamId string, keys []string, track *Track, filename string, cover []byte, lyrics string) error {
 	//fmt.Printf("%d-bit / %d Hz\n", info.bitDepth, info.bitRate)
 	conn, err := net.Dial("tcp", "127.0.0.1:10020")
 	if err != nil {
@@ -1533,7 +3689,7 @@ func decryptSong(info *SongInfo, keys []string, manifest *AutoGenerated, filenam
 				}
 			}
 			keyUri := keys[sp.descIndex]
-			id := manifest.Data[0].Relationships.Tracks.Data[trackNum-1].ID
+			id := adamId
 			if keyUri == prefetchKey {
 				id = defaultId
 			}
@@ -1573,158 +3729,738 @@ func decryptSong(info *SongInfo, keys []string, manifest *AutoGenerated, filenam
 		if err != nil {
 			return err
 		}
-
-		decrypted = append(decrypted, de...)
+
+		decrypted = append(decrypted, de...)
+	}
+	_, _ = conn.Write([]byte{0, 0, 0, 0, 0})
+
+	fmt.Println("Decrypt finished.")
+
+	create, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer create.Close()
+
+	err = writeM4a(mp4.NewWriter(create), info, track, decrypted, cover, lyrics)
+	if err != nil {
+		return err
+	}
+	if config.BoxReport {
+		err = printBoxDiff(info.r, create)
+		if err != nil {
+			fmt.Println("Failed to diff boxes.", err)
+		}
+	}
+	return nil
+}
+
+var (
+	albumUrlPat = regexp.MustCompile(`^(?:https:\/\/(?:beta\.music|music)\.apple\.com\/(\w{2})(?:\/album|\/album\/.+))\/(?:id)?(\d[^\D]+)(?:$|\?)`)
+	songUrlPat  = regexp.MustCompile(`^(?:https:\/\/(?:beta\.music|music)\.apple\.com\/(\w{2})(?:\/song|\/song\/.+))\/(?:id)?(\d[^\D]+)(?:$|\?)`)
+	songIdPat   = regexp.MustCompile(`[?&]i=(\d+)`)
+	artistPat   = regexp.MustCompile(`^(?:https:\/\/(?:beta\.music|music)\.apple\.com\/(\w{2})(?:\/artist|\/artist\/.+))\/(?:id)?(\d[^\D]+)(?:$|\?)`)
+	playlistPat = regexp.MustCompile(`^(?:https:\/\/(?:beta\.music|music)\.apple\.com\/(\w{2})(?:\/playlist|\/playlist\/.+))\/(pl\.[\w-]+)(?:$|\?)`)
+
+	libraryAlbumPat    = regexp.MustCompile(`^https:\/\/(?:beta\.music|music)\.apple\.com(?:\/\w{2})?\/library\/albums\/(l\.[\w-]+)(?:$|\?)`)
+	libraryPlaylistPat = regexp.MustCompile(`^https:\/\/(?:beta\.music|music)\.apple\.com(?:\/\w{2})?\/library\/playlist\/(p\.[\w-]+)(?:$|\?)`)
+)
+
+// checkUrl 返回 storefront、专辑 ID 和单曲 ID，单曲链接的专辑 ID 为空，需要再通过 getInfoFromAdam 查询
+func checkUrl(url string) (string, string, string) {
+	if matches := albumUrlPat.FindStringSubmatch(url); matches != nil {
+		var songId string
+		if m := songIdPat.FindStringSubmatch(url); m != nil {
+			songId = m[1]
+		}
+		return matches[1], matches[2], songId
+	}
+	if matches := songUrlPat.FindStringSubmatch(url); matches != nil {
+		return matches[1], "", matches[2]
+	}
+	return "", "", ""
+}
+
+func checkPlaylistUrl(url string) (string, string) {
+	matches := playlistPat.FindStringSubmatch(url)
+	if matches == nil {
+		return "", ""
+	}
+	return matches[1], matches[2]
+}
+
+// checkLibraryUrl 返回资料库专辑 ID 和资料库歌单 ID
+func checkLibraryUrl(url string) (string, string) {
+	if matches := libraryAlbumPat.FindStringSubmatch(url); matches != nil {
+		return matches[1], ""
+	}
+	if matches := libraryPlaylistPat.FindStringSubmatch(url); matches != nil {
+		return "", matches[1]
+	}
+	return "", ""
+}
+
+func checkArtistUrl(url string) (string, string) {
+	matches := artistPat.FindStringSubmatch(url)
+	if matches == nil {
+		return "", ""
+	}
+	return matches[1], matches[2]
+}
+
+// getMeta 获取专辑信息，language 为空时使用地区默认语言
+func getMeta(albumId string, storefront string, language string) (*AutoGenerated, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/albums/%s", storefront, albumId), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+	req.Header.Set("Origin", "https://music.apple.com")
+	query := url.Values{}
+	query.Set("omit[resource]", "autos")
+	query.Set("include", "tracks,artists,record-labels")
+	query.Set("include[songs]", "artists")
+	// fields[artists] 同样作用于 include[songs] 带出的曲目艺人，艺人推荐语只用于 description 文件
+	if config.Description {
+		query.Set("fields[artists]", "name,editorialNotes")
+	} else {
+		query.Set("fields[artists]", "name")
+	}
+	query.Set("fields[albums:albums]", "artistName,artwork,name,releaseDate,url,upc,recordLabel,copyright,isCompilation,trackCount,audioTraits,editorialNotes")
+	query.Set("fields[record-labels]", "name")
+	if language != "" {
+		query.Set("l", language)
+	}
+	req.URL.RawQuery = query.Encode()
+	do, err := doApi(req)
+	if err != nil {
+		return nil, err
+	}
+	defer do.Body.Close()
+	if do.StatusCode != http.StatusOK {
+		return nil, newApiError(do)
+	}
+	obj := new(AutoGenerated)
+	err = json.NewDecoder(do.Body).Decode(&obj)
+	if err != nil {
+		return nil, err
+	}
+	if len(obj.Data) == 0 {
+		return nil, errors.New("album not found")
+	}
+	// 曲目较多时 tracks 会分页，需按 next 取完
+	// 翻页请求同样带上 l 和 fields，否则后面的曲目会回到地区默认语言
+	pageQuery := url.Values{}
+	pageQuery.Set("include", "artists")
+	for _, k := range []string{"include[songs]", "fields[artists]", "l"} {
+		if v := query.Get(k); v != "" {
+			pageQuery.Set(k, v)
+		}
+	}
+	tracks := &obj.Data[0].Relationships.Tracks
+	for tracks.Next != "" {
+		page := new(AlbumTracks)
+		err = getApi(tracks.Next, pageQuery, page)
+		if err != nil {
+			return nil, err
+		}
+		tracks.Data = append(tracks.Data, page.Data...)
+		tracks.Next = page.Next
+	}
+	return obj, nil
+}
+
+func getCover(url string) ([]byte, error) {
+	url = strings.Replace(url, "{w}x{h}", fmt.Sprintf("%dx%d", config.CoverSize, config.CoverSize), 1)
+	if config.CoverFormat == "png" {
+		url = strings.Replace(url, "bb.jpg", "bb.png", 1)
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+	do, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer do.Body.Close()
+	if do.StatusCode != http.StatusOK {
+		return nil, errors.New(do.Status)
+	}
+	return io.ReadAll(do.Body)
+}
+
+func writeCover(sanAlbumFolder string, cover []byte) error {
+	covPath := filepath.Join(sanAlbumFolder, "cover."+config.CoverFormat)
+	exists, err := fileExists(covPath)
+	if err != nil {
+		fmt.Println("Failed to check if cover exists.")
+		return err
+	}
+	if exists {
+		return nil
+	}
+	return ioutil.WriteFile(covPath, cover, 0644)
+}
+
+// covr 的数据类型，13 为 JPEG，14 为 PNG
+func coverDataType(cover []byte) uint32 {
+	if bytes.HasPrefix(cover, []byte("\x89PNG")) {
+		return 14
+	}
+	return 13
+}
+
+type StreamInfo struct {
+	URL        string   `json:"url"`
+	Keys       []string `json:"keys"`
+	Codec      string   `json:"codec"`                // alac、mp4a 或 ec-3
+	BitDepth   string   `json:"bitDepth,omitempty"`   // 仅 alac
+	SampleRate string   `json:"sampleRate,omitempty"` // 仅 alac
+	Bitrate    string   `json:"bitrate,omitempty"`    // kbps，仅 mp4a 和 ec-3
+}
+
+var keyUriPat = regexp.MustCompile(`URI="(skd?://[^"]*)"`)
+
+// extractMediaPlaylist 从 AAC 和杜比全景声的媒体播放列表中取得文件地址和按出现顺序排列的密钥
+func extractMediaPlaylist(playlistUrl *url.URL) (string, []string, error) {
+	resp, err := http.Get(playlistUrl.String())
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, errors.New(resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	from, listType, err := m3u8.DecodeFrom(bytes.NewReader(body), true)
+	if err != nil || listType != m3u8.MEDIA {
+		return "", nil, errors.New("m3u8 not of media type")
+	}
+	media := from.(*m3u8.MediaPlaylist)
+	var fileUri string
+	if media.Map != nil {
+		fileUri = media.Map.URI
+	} else if len(media.Segments) != 0 && media.Segments[0] != nil {
+		fileUri = media.Segments[0].URI
+	}
+	if fileUri == "" {
+		return "", nil, errors.New("no segment found")
+	}
+	fileUrl, err := playlistUrl.Parse(fileUri)
+	if err != nil {
+		return "", nil, err
+	}
+
+	keys := []string{prefetchKey}
+	seen := map[string]bool{prefetchKey: true}
+	for _, match := range keyUriPat.FindAllStringSubmatch(string(body), -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			keys = append(keys, match[1])
+		}
+	}
+	return fileUrl.String(), keys, nil
+}
+
+type QualityPolicy struct {
+	MaxBitDepth   int      `yaml:"max_bit_depth" json:"maxBitDepth,omitempty"`     // 0 表示不限制
+	MaxSampleRate int      `yaml:"max_sample_rate" json:"maxSampleRate,omitempty"` // 0 表示不限制
+	PreferExact   bool     `yaml:"prefer_exact" json:"preferExact,omitempty"`      // 优先选择与上限完全相同的版本
+	Fallback      []string `yaml:"fallback" json:"fallback,omitempty"`             // lower: 上限内最高，higher: 超出上限的最低
+	Codecs        []string `yaml:"codecs" json:"codecs,omitempty"`                 // 依次尝试的编码: alac、ec-3 (杜比全景声)、mp4a (AAC)，默认只有 alac
+}
+
+func (p *QualityPolicy) within(sampleRate, bitDepth int) bool {
+	return (p.MaxSampleRate == 0 || sampleRate <= p.MaxSampleRate) &&
+		(p.MaxBitDepth == 0 || bitDepth <= p.MaxBitDepth)
+}
+
+func (p *QualityPolicy) exact(sampleRate, bitDepth int) bool {
+	return (p.MaxSampleRate == 0 || sampleRate == p.MaxSampleRate) &&
+		(p.MaxBitDepth == 0 || bitDepth == p.MaxBitDepth)
+}
+
+// parseAudioGroup 从 audio-alac-stereo-44100-16 这样的 group ID 中取出采样率和位深
+func parseAudioGroup(audio string) (sampleRate int, bitDepth int) {
+	split := strings.Split(audio, "-")
+	length := len(split)
+	if length < 2 {
+		return
+	}
+	sampleRate, _ = strconv.Atoi(split[length-2])
+	bitDepth, _ = strconv.Atoi(split[length-1])
+	return
+}
+
+var (
+	qualityFallbacks = map[string]bool{"lower": true, "higher": true}
+	qualityCodecs    = map[string]bool{"alac": true, "ec-3": true, "mp4a": true}
+)
+
+// parseQuality 用请求参数覆盖默认音质策略，参数无法解析或取值未知时返回错误
+func parseQuality(query func(string) string, quality QualityPolicy) (QualityPolicy, error) {
+	var err error
+	if v := query("max_bit_depth"); v != "" {
+		quality.MaxBitDepth, err = strconv.Atoi(v)
+		if err != nil || quality.MaxBitDepth < 0 {
+			return quality, fmt.Errorf("invalid max_bit_depth %q", v)
+		}
+	}
+	if v := query("max_sample_rate"); v != "" {
+		quality.MaxSampleRate, err = strconv.Atoi(v)
+		if err != nil || quality.MaxSampleRate < 0 {
+			return quality, fmt.Errorf("invalid max_sample_rate %q", v)
+		}
+	}
+	if v := query("prefer_exact"); v != "" {
+		quality.PreferExact, err = strconv.ParseBool(v)
+		if err != nil {
+			return quality, fmt.Errorf("invalid prefer_exact %q", v)
+		}
+	}
+	if v := query("fallback"); v != "" {
+		quality.Fallback = strings.Split(v, ",")
+		for _, f := range quality.Fallback {
+			if !qualityFallbacks[f] {
+				return quality, fmt.Errorf("unknown fallback %q", f)
+			}
+		}
+	}
+	if v := query("codecs"); v != "" {
+		quality.Codecs = strings.Split(v, ",")
+		for _, codec := range quality.Codecs {
+			if !qualityCodecs[codec] {
+				return quality, fmt.Errorf("unknown codec %q", codec)
+			}
+		}
+	}
+	return quality, nil
+}
+
+// selectVariant 按 codecs 的顺序依次尝试，alac 按音质策略选择，其余选码率最高的版本，没有符合的返回 nil
+func selectVariant(variants []*m3u8.Variant, policy *QualityPolicy) *m3u8.Variant {
+	codecs := policy.Codecs
+	if len(codecs) == 0 {
+		codecs = []string{"alac"}
+	}
+	for _, codec := range codecs {
+		var variant *m3u8.Variant
+		if codec == "alac" {
+			variant = selectAlacVariant(variants, policy)
+		} else {
+			for _, v := range variants {
+				if strings.HasPrefix(v.Codecs, codec) && (variant == nil || v.AverageBandwidth > variant.AverageBandwidth) {
+					variant = v
+				}
+			}
+		}
+		if variant != nil {
+			return variant
+		}
+	}
+	return nil
+}
+
+func selectAlacVariant(variants []*m3u8.Variant, policy *QualityPolicy) *m3u8.Variant {
+	var candidates []*m3u8.Variant
+	for _, variant := range variants {
+		if variant.Codecs == "alac" {
+			candidates = append(candidates, variant)
+		}
+	}
+	// 从高到低排序
+	sort.Slice(candidates, func(i, j int) bool {
+		ri, bi := parseAudioGroup(candidates[i].Audio)
+		rj, bj := parseAudioGroup(candidates[j].Audio)
+		if ri != rj {
+			return ri > rj
+		}
+		if bi != bj {
+			return bi > bj
+		}
+		return candidates[i].AverageBandwidth > candidates[j].AverageBandwidth
+	})
+	if policy.PreferExact {
+		for _, c := range candidates {
+			if policy.exact(parseAudioGroup(c.Audio)) {
+				return c
+			}
+		}
+	}
+	fallback := policy.Fallback
+	if len(fallback) == 0 {
+		fallback = []string{"lower", "higher"}
+	}
+	for _, f := range fallback {
+		switch f {
+		case "lower":
+			for _, c := range candidates {
+				if policy.within(parseAudioGroup(c.Audio)) {
+					return c
+				}
+			}
+		case "higher":
+			for i := len(candidates) - 1; i >= 0; i-- {
+				if !policy.within(parseAudioGroup(candidates[i].Audio)) {
+					return candidates[i]
+				}
+			}
+		}
 	}
-	_, _ = conn.Write([]byte{0, 0, 0, 0, 0})
-
-	fmt.Println("Decrypt finished.")
+	return nil
+}
 
-	create, err := os.Create(filename)
+// getMaster 下载并解析主播放列表，同时返回原文用于查找密钥
+func getMaster(b string) (*m3u8.MasterPlaylist, string, error) {
+	resp, err := http.Get(b)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
-	defer create.Close()
-
-	return writeM4a(mp4.NewWriter(create), info, manifest, decrypted, trackNum, trackTotal)
-}
-
-func checkUrl(url string) (string, string) {
-	pat := regexp.MustCompile(`^(?:https:\/\/(?:beta\.music|music)\.apple\.com\/(\w{2})(?:\/album|\/album\/.+))\/(?:id)?(\d[^\D]+)(?:$|\?)`)
-	matches := pat.FindAllStringSubmatch(url, -1)
-	if matches == nil {
-		return "", ""
-	} else {
-		return matches[0][1], matches[0][2]
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", errors.New(resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	masterString := string(body)
+	from, listType, err := m3u8.DecodeFrom(strings.NewReader(masterString), true)
+	if err != nil || listType != m3u8.MASTER {
+		return nil, "", errors.New("m3u8 not of master type")
 	}
+	return from.(*m3u8.MasterPlaylist), masterString, nil
 }
 
-func getMeta(albumId string, token string, storefront string) (*AutoGenerated, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/albums/%s", storefront, albumId), nil)
+func extractMedia(b string, policy *QualityPolicy) (*StreamInfo, error) {
+	masterUrl, err := url.Parse(b)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
-	req.Header.Set("Origin", "https://music.apple.com")
-	query := url.Values{}
-	query.Set("omit[resource]", "autos")
-	query.Set("include", "tracks,artists,record-labels")
-	query.Set("include[songs]", "artists")
-	query.Set("fields[artists]", "name")
-	query.Set("fields[albums:albums]", "artistName,artwork,name,releaseDate,url")
-	query.Set("fields[record-labels]", "name")
-	// query.Set("l", "en-gb")
-	req.URL.RawQuery = query.Encode()
-	do, err := http.DefaultClient.Do(req)
+	master, masterString, err := getMaster(b)
 	if err != nil {
 		return nil, err
 	}
-	defer do.Body.Close()
-	if do.StatusCode != http.StatusOK {
-		return nil, errors.New(do.Status)
+	stream := new(StreamInfo)
+	variant := selectVariant(master.Variants, policy)
+	if variant == nil {
+		return nil, fmt.Errorf("no variant found for codecs %v: %w", policy.Codecs, ErrUnavailable)
 	}
-	obj := new(AutoGenerated)
-	err = json.NewDecoder(do.Body).Decode(&obj)
+	streamUrl, err := masterUrl.Parse(variant.URI)
 	if err != nil {
 		return nil, err
 	}
-	return obj, nil
+	if variant.Codecs != "alac" {
+		stream.Codec = strings.Split(variant.Codecs, ".")[0]
+		stream.Bitrate = strconv.Itoa(int(variant.AverageBandwidth / 1000))
+		fmt.Printf("%s / %s kbps\n", variant.Codecs, stream.Bitrate)
+		stream.URL, stream.Keys, err = extractMediaPlaylist(streamUrl)
+		if err != nil {
+			return nil, err
+		}
+		return stream, nil
+	}
+	sampleRate, bitDepth := parseAudioGroup(variant.Audio)
+	stream.Codec = variant.Codecs
+	stream.BitDepth, stream.SampleRate = strconv.Itoa(bitDepth), strconv.Itoa(sampleRate)
+	fmt.Printf("%s-bit / %s Hz\n", stream.BitDepth, stream.SampleRate)
+	var keys []string
+	keys = append(keys, prefetchKey)
+	streamUrl.Path = strings.TrimSuffix(streamUrl.Path, ".m3u8") + "_m.mp4"
+	regex := regexp.MustCompile(`"(skd?://[^"]*)"`)
+	matches := regex.FindAllStringSubmatch(masterString, -1)
+	for _, match := range matches {
+		if strings.HasSuffix(match[1], "c23") || strings.HasSuffix(match[1], "c6") {
+			keys = append(keys, match[1])
+		}
+	}
+	stream.URL = streamUrl.String()
+	stream.Keys = keys
+	return stream, nil
 }
 
-func writeCover(sanAlbumFolder, url string) error {
-	covPath := filepath.Join(sanAlbumFolder, "cover.jpg")
-	exists, err := fileExists(covPath)
-	if err != nil {
-		fmt.Println("Failed to check if cover exists.")
-		return err
+type VariantInfo struct {
+	Codec            string `json:"codec"`
+	Audio            string `json:"audio"`
+	BitDepth         int    `json:"bitDepth,omitempty"`
+	SampleRate       int    `json:"sampleRate,omitempty"`
+	Bandwidth        uint32 `json:"bandwidth"`
+	AverageBandwidth uint32 `json:"averageBandwidth"`
+}
+
+type TrackQualities struct {
+	ID          string        `json:"id"`
+	Name        string        `json:"name"`
+	DiscNumber  int           `json:"discNumber"`
+	TrackNumber int           `json:"trackNumber"`
+	AudioTraits []string      `json:"audioTraits"`
+	Variants    []VariantInfo `json:"variants"`
+	Error       string        `json:"error,omitempty"`
+}
+
+type AlbumQualities struct {
+	ID          string           `json:"id"`
+	Name        string           `json:"name"`
+	ArtistName  string           `json:"artistName"`
+	AudioTraits []string         `json:"audioTraits"`
+	Tracks      []TrackQualities `json:"tracks"`
+}
+
+// getQualities 列出专辑 (或单曲) 每个曲目主播放列表中的所有版本，不经过 agent
+func getQualities(link string, language string) (*AlbumQualities, error) {
+	if language == "" {
+		language = config.Language
 	}
-	if exists {
-		return nil
+	storefront, albumId, songId := checkUrl(link)
+	if albumId == "" && songId == "" {
+		albumId, _ = checkLibraryUrl(link)
 	}
-	url = strings.Replace(url, "{w}x{h}", "1200x12000", 1)
-	req, err := http.NewRequest("GET", url, nil)
+	if albumId == "" && songId == "" {
+		return nil, ErrInvalidUrl
+	}
+	var err error
+	if isLibraryId(albumId) {
+		albumId, err = getLibraryAlbum(albumId)
+		if err != nil {
+			return nil, err
+		}
+		storefront, err = getUserStorefront()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if albumId == "" {
+		albumId, err = getAlbumIdOfSong(songId, storefront)
+		if err != nil {
+			return nil, err
+		}
+	}
+	meta, err := getMeta(albumId, storefront, language)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
-	do, err := http.DefaultClient.Do(req)
+	album, err := newAlbum(meta, storefront, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer do.Body.Close()
-	if do.StatusCode != http.StatusOK {
-		errors.New(do.Status)
+	qualities := &AlbumQualities{
+		ID:          album.ID,
+		Name:        album.Name,
+		ArtistName:  album.ArtistName,
+		AudioTraits: album.AudioTraits,
+	}
+	for _, track := range album.Tracks {
+		if songId != "" && track.ID != songId {
+			continue
+		}
+		t := TrackQualities{
+			ID:          track.ID,
+			Name:        track.Name,
+			AudioTraits: track.AudioTraits,
+			DiscNumber:  track.DiscNumber,
+			TrackNumber: track.TrackNumber,
+		}
+		t.Variants, err = getTrackVariants(track.ID, storefront)
+		if err != nil {
+			t.Error = err.Error()
+		}
+		qualities.Tracks = append(qualities.Tracks, t)
 	}
-	f, err := os.Create(covPath)
+	return qualities, nil
+}
+
+func getTrackVariants(songId string, storefront string) ([]VariantInfo, error) {
+	manifest, err := getInfoFromAdam(songId, storefront)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
-	_, err = io.Copy(f, do.Body)
+	if manifest == nil || manifest.Attributes.ExtendedAssetUrls.EnhancedHls == "" {
+		return nil, ErrUnavailable
+	}
+	master, _, err := getMaster(manifest.Attributes.ExtendedAssetUrls.EnhancedHls)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	var variants []VariantInfo
+	for _, v := range master.Variants {
+		info := VariantInfo{
+			Codec:            v.Codecs,
+			Audio:            v.Audio,
+			Bandwidth:        v.Bandwidth,
+			AverageBandwidth: v.AverageBandwidth,
+		}
+		if v.Codecs == "alac" {
+			info.SampleRate, info.BitDepth = parseAudioGroup(v.Audio)
+		}
+		variants = append(variants, info)
+	}
+	return variants, nil
 }
 
-func extractMedia(b string) (string, []string, error) {
-	masterUrl, err := url.Parse(b)
+type Task struct {
+	Url        string         `json:"url"`
+	AlbumId    string         `json:"albumId"`
+	SongId     string         `json:"songId,omitempty"`
+	PlaylistId string         `json:"playlistId,omitempty"`
+	ArtistId   string         `json:"artistId,omitempty"`
+	Artist     *ArtistFilter  `json:"artist,omitempty"`
+	Dir        string         `json:"dir,omitempty"`
+	Quality    *QualityPolicy `json:"quality,omitempty"`
+	Language   string         `json:"language,omitempty"`
+	Storefront string         `json:"storefront"`
+	Error      string         `json:"error,omitempty"`
+	Failures   []TrackFailure `json:"failures,omitempty"` // 失败曲目及原因
+
+	TrackStorefronts map[string]string `json:"trackStorefronts,omitempty"` // 从备用地区下载的曲目 ID 到 storefront
+}
+
+// TrackFailure 任务报告中的单曲失败记录，Reason 为 not_found、unauthorized、rate_limited、server_error、unavailable 或 error
+type TrackFailure struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+	Error  string `json:"error"`
+}
+
+// root 返回任务的下载目录，未指定时使用配置中的 download_dir
+func (t *Task) root() string {
+	if t.Dir != "" {
+		return t.Dir
+	}
+	return config.DownloadDir
+}
+
+// language 返回任务的元数据语言，未指定时使用配置中的 language
+func (t *Task) language() string {
+	if t.Language != "" {
+		return t.Language
+	}
+	return config.Language
+}
+
+func (t *Task) quality() *QualityPolicy {
+	if t.Quality != nil {
+		return t.Quality
+	}
+	return &config.Quality
+}
+
+// resolvePath 将路径转为绝对路径，并解析其中最近一级已存在目录的符号链接
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
 	if err != nil {
-		return "", nil, err
+		return "", err
 	}
-	resp, err := http.Get(b)
+	existing, rest := abs, ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
 	if err != nil {
-		return "", nil, err
+		return "", err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return "", nil, errors.New(resp.Status)
+	return filepath.Join(resolved, rest), nil
+}
+
+// checkDir 检查请求中的下载目录，相对路径以 download_dir 为起点，解析符号链接后必须位于 allowed_dirs 或 download_dir 之内
+func checkDir(dir string) (string, error) {
+	for _, part := range strings.Split(filepath.ToSlash(dir), "/") {
+		if part == ".." {
+			return "", errors.New("path traversal not allowed")
+		}
 	}
-	body, err := io.ReadAll(resp.Body)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(config.DownloadDir, dir)
+	}
+	abs, err := resolvePath(dir)
 	if err != nil {
-		return "", nil, err
+		return "", err
 	}
-	masterString := string(body)
-	from, listType, err := m3u8.DecodeFrom(strings.NewReader(masterString), true)
-	if err != nil || listType != m3u8.MASTER {
-		return "", nil, errors.New("m3u8 not of master type")
+	for _, allowed := range append([]string{config.DownloadDir}, config.AllowedDirs...) {
+		allowedAbs, err := resolvePath(allowed)
+		if err != nil {
+			continue
+		}
+		if abs == allowedAbs || strings.HasPrefix(abs, allowedAbs+string(filepath.Separator)) {
+			return abs, nil
+		}
 	}
-	master := from.(*m3u8.MasterPlaylist)
-	var streamUrl *url.URL
-	sort.Slice(master.Variants, func(i, j int) bool {
-		return master.Variants[i].AverageBandwidth > master.Variants[j].AverageBandwidth
-	})
-	for _, variant := range master.Variants {
-		if variant.Codecs == "alac" {
-			split := strings.Split(variant.Audio, "-")
-			length := len(split)
-			fmt.Printf("%s-bit / %s Hz\n", split[length-1], split[length-2])
-			streamUrlTemp, err := masterUrl.Parse(variant.URI)
-			if err != nil {
-				panic(err)
+	return "", errors.New("dir not in allowed_dirs")
+}
+
+func Download(task *Task) (err error) {
+	if task.ArtistId != "" {
+		tasks, err := getArtistAlbums(task.ArtistId, task.Artist, task.Storefront)
+		if err != nil {
+			fmt.Println("Failed to list artist albums.")
+			fmt.Println(err)
+			return err
+		}
+		for i := range tasks {
+			tasks[i].Dir = task.Dir
+			tasks[i].Quality = task.Quality
+			tasks[i].Language = task.Language
+		}
+		fmt.Printf("Artist %s, %d albums queued\n", task.ArtistId, len(tasks))
+		// 由下载协程自己入队，放到新协程里避免队列满时阻塞
+		go func() {
+			for _, t := range tasks {
+				taskQueue <- t
 			}
-			streamUrl = streamUrlTemp
-			break
+		}()
+		return nil
+	}
+	if task.Storefront == "" {
+		// 资料库链接
+		task.Storefront, err = getUserStorefront()
+		if err != nil {
+			fmt.Println("Failed to get storefront.")
+			fmt.Println(err)
+			return
 		}
 	}
-	if streamUrl == nil {
-		return "", nil, errors.New("no alac codec found")
+	if task.PlaylistId != "" {
+		err = ripPlaylist(task)
+		if err != nil {
+			fmt.Println("Playlist failed.")
+			fmt.Println(err)
+		}
+		return
 	}
-	var keys []string
-	keys = append(keys, prefetchKey)
-	streamUrl.Path = strings.TrimSuffix(streamUrl.Path, ".m3u8") + "_m.mp4"
-	regex := regexp.MustCompile(`"(skd?://[^"]*)"`)
-	matches := regex.FindAllStringSubmatch(masterString, -1)
-	for _, match := range matches {
-		if strings.HasSuffix(match[1], "c23") || strings.HasSuffix(match[1], "c6") {
-			keys = append(keys, match[1])
+	if isLibraryId(task.AlbumId) {
+		task.AlbumId, err = getLibraryAlbum(task.AlbumId)
+		if err != nil {
+			fmt.Println("Failed to find library album in catalog.")
+			fmt.Println(err)
+			return
 		}
 	}
-	return streamUrl.String(), keys, nil
-}
-func Download(albumId, storefront string) (err error) {
-	err = rip(albumId, token, storefront)
+	if task.AlbumId == "" {
+		task.AlbumId, err = getAlbumIdOfSong(task.SongId, task.Storefront)
+		if err != nil {
+			fmt.Println("Failed to find album of song.")
+			fmt.Println(err)
+			return
+		}
+	}
+	var songIds []string
+	if task.SongId != "" {
+		songIds = append(songIds, task.SongId)
+	}
+	_, err = rip(task, task.AlbumId, songIds)
 	if err != nil {
 		fmt.Println("Album failed.")
 		fmt.Println(err)
@@ -1733,21 +4469,93 @@ func Download(albumId, storefront string) (err error) {
 }
 
 var (
-	token     string
-	taskQueue = make(chan []string)
-	failQueue = make(chan []string)
-	succQueue = make(chan []string)
-	DeConfig  = Config{
-		FridaPath:       "frida",
-		FridaServerPath: "/data/local/tmp/frida-server-16.2.1-android-x86_64",
-		Port:            "8080",
+	token       string
+	tokenExpiry time.Time
+	tokenMu     sync.Mutex
+	taskQueue   = make(chan Task, 100)
+	failQueue   = make(chan Task, 100)
+	succQueue   = make(chan Task, 100)
+	failDropped int64
+	succDropped int64
+	config      Config
+	DeConfig    = Config{
+		FridaPath:             "frida",
+		FridaServerPath:       "/data/local/tmp/frida-server-16.2.1-android-x86_64",
+		Port:                  "8080",
+		DownloadDir:           "AM-DL downloads",
+		TokenCache:            ".token",
+		EmbedCover:            true,
+		CoverSize:             1200,
+		CoverFormat:           "jpg",
+		AlbumFolderFormat:     "{albumArtist} - {album}",
+		DiscFolderFormat:      "Disc {disc}",
+		SongFileFormat:        "{track:2}. {title}",
+		MultiDiscFileFormat:   "{disc}-{track:2}. {title}",
+		MaxNameLength:         200,
+		SecondaryLanguageMode: "sort",
+		Sanitize:              "windows",
+		Quality: QualityPolicy{
+			Codecs: []string{"alac"},
+		},
+		Artist: ArtistFilter{
+			Types: []string{"full-albums", "singles", "compilation-albums", "live-albums"},
+		},
 	}
 )
 
 type Config struct {
-	FridaPath       string `yaml:"frida_path"`
-	FridaServerPath string `yaml:"frida_server_path"`
-	Port            string `yaml:"port"`
+	FridaPath             string        `yaml:"frida_path"`
+	FridaServerPath       string        `yaml:"frida_server_path"`
+	Port                  string        `yaml:"port"`
+	DownloadDir           string        `yaml:"download_dir"`            // 下载根目录
+	Token                 string        `yaml:"token"`                   // 手动指定的 token，抓取失败时使用
+	TokenCache            string        `yaml:"token_cache"`             // token 缓存文件
+	Credits               bool          `yaml:"credits"`                 // 获取 credits，写入 CONDUCTOR、PERFORMER 等 freeform 标签
+	Description           bool          `yaml:"description"`             // 在专辑文件夹写出 description.txt 和 description.html
+	EmbedDescription      bool          `yaml:"embed_description"`       // 将推荐语写入 desc 和 ldes
+	Sidecar               bool          `yaml:"sidecar"`                 // 在专辑文件夹写出 album.json
+	Nfo                   bool          `yaml:"nfo"`                     // 在专辑文件夹写出 Kodi 的 album.nfo
+	Language              string        `yaml:"language"`                // 元数据语言，如 en-GB，为空时使用地区默认语言
+	SecondaryLanguage     string        `yaml:"secondary_language"`      // 第二语言，为空时不获取
+	SecondaryLanguageMode string        `yaml:"secondary_language_mode"` // sort 写入排序字段，original 写入 ORIGINALTITLE 和 ORIGINALALBUM
+	FallbackStorefronts   []string      `yaml:"fallback_storefronts"`    // 曲目在链接地区不可用时依次尝试的地区
+	MediaUserToken        string        `yaml:"media_user_token"`        // 账号的 Media-User-Token，资料库链接需要
+	AllowedDirs           []string      `yaml:"allowed_dirs"`            // addDownload 的 dir 参数允许使用的目录
+	EmbedCover            bool          `yaml:"embed_cover"`             // 是否将封面写入covr
+	CoverSize             int           `yaml:"cover_size"`              // 封面最大边长
+	CoverFormat           string        `yaml:"cover_format"`            // jpg 或 png
+	Lyrics                bool          `yaml:"lyrics"`                  // 下载歌词，保存为 .lrc，需要 media_user_token
+	EmbedLyrics           bool          `yaml:"embed_lyrics"`            // 将不带时间轴的歌词写入©lyr
+	FaithfulRemux         bool          `yaml:"faithful_remux"`          // 保留源文件中除加密外的所有 box
+	BoxReport             bool          `yaml:"box_report"`              // 打印源文件与输出文件的 box 差异
+	Artist                ArtistFilter  `yaml:"artist"`                  // 艺人链接默认的专辑筛选
+	Quality               QualityPolicy `yaml:"quality"`                 // 默认音质策略
+	DiscFolders           bool          `yaml:"disc_folders"`            // 多碟专辑按 Disc N 分文件夹
+
+	// 命名模板，可用字段: {albumArtist} {album} {year} {disc} {track} {title} {artist}
+	// {isrc} {upc} {bitDepth} {sampleRate} {bitrate} {codec} {storefront}，{track:2} 表示补零到两位
+	AlbumFolderFormat   string `yaml:"album_folder_format"`
+	DiscFolderFormat    string `yaml:"disc_folder_format"`
+	SongFileFormat      string `yaml:"song_file_format"`
+	MultiDiscFileFormat string `yaml:"multi_disc_file_format"` // 多碟且不分文件夹时使用
+	MaxNameLength       int    `yaml:"max_name_length"`        // 每级文件名的最大字节数
+	Sanitize            string `yaml:"sanitize"`               // windows、macos 或 linux
+}
+
+// pushTask 队列满时丢弃最早的任务，避免阻塞下载协程，丢弃的数量记入 dropped，在 /status 中显示
+func pushTask(queue chan Task, dropped *int64, task Task) {
+	for {
+		select {
+		case queue <- task:
+			return
+		default:
+			select {
+			case <-queue:
+				atomic.AddInt64(dropped, 1)
+			default:
+			}
+		}
+	}
 }
 
 func ReadConfig() (config Config, err error) {
@@ -1755,6 +4563,7 @@ func ReadConfig() (config Config, err error) {
 	if err != nil {
 		return
 	}
+	config = DeConfig
 	err = yaml.Unmarshal(yamlFile, &config)
 	if err != nil {
 		return
@@ -1769,6 +4578,66 @@ func ReadConfig() (config Config, err error) {
 	if config.Port == "" {
 		config.Port = "8080"
 	}
+	if config.DownloadDir == "" {
+		config.DownloadDir = DeConfig.DownloadDir
+	}
+	if config.TokenCache == "" {
+		config.TokenCache = DeConfig.TokenCache
+	}
+	if config.CoverSize <= 0 {
+		config.CoverSize = DeConfig.CoverSize
+	}
+	if config.CoverFormat != "png" {
+		config.CoverFormat = "jpg"
+	}
+	if config.AlbumFolderFormat == "" {
+		config.AlbumFolderFormat = DeConfig.AlbumFolderFormat
+	}
+	if config.DiscFolderFormat == "" {
+		config.DiscFolderFormat = DeConfig.DiscFolderFormat
+	}
+	if config.SongFileFormat == "" {
+		config.SongFileFormat = DeConfig.SongFileFormat
+	}
+	if config.MultiDiscFileFormat == "" {
+		config.MultiDiscFileFormat = DeConfig.MultiDiscFileFormat
+	}
+	if config.MaxNameLength <= 0 {
+		config.MaxNameLength = DeConfig.MaxNameLength
+	}
+	switch config.SecondaryLanguageMode {
+	case "":
+		config.SecondaryLanguageMode = DeConfig.SecondaryLanguageMode
+	case "sort", "original":
+	default:
+		err = fmt.Errorf("unknown secondary_language_mode %q", config.SecondaryLanguageMode)
+		return
+	}
+	if config.Sanitize == "" {
+		config.Sanitize = DeConfig.Sanitize
+	}
+	if _, ok := forbiddenNames[config.Sanitize]; !ok {
+		err = fmt.Errorf("unknown sanitize %q", config.Sanitize)
+		return
+	}
+	for _, template := range []string{config.AlbumFolderFormat, config.DiscFolderFormat, config.SongFileFormat, config.MultiDiscFileFormat} {
+		err = checkTemplate(template)
+		if err != nil {
+			return
+		}
+	}
+	for _, f := range config.Quality.Fallback {
+		if !qualityFallbacks[f] {
+			err = fmt.Errorf("unknown quality.fallback %q", f)
+			return
+		}
+	}
+	for _, codec := range config.Quality.Codecs {
+		if !qualityCodecs[codec] {
+			err = fmt.Errorf("unknown quality.codecs %q", codec)
+			return
+		}
+	}
 	return
 
 }
@@ -1803,23 +4672,47 @@ func runCmd(cmd *exec.Cmd) (err error) {
 	return
 }
 func InitGin() (err error) {
-	token, err = getToken()
+	_, err = getValidToken()
 	if err != nil {
 		fmt.Println("Failed to get token.")
 		return
 	}
+	if config.Lyrics && config.MediaUserToken == "" {
+		// 歌词接口按账号鉴权，没有 media_user_token 时跳过
+		fmt.Println("lyrics is enabled but media_user_token is not set, lyrics will be skipped.")
+	}
 	return
 }
 func main() {
-	config, err := ReadConfig()
+	var err error
+	config, err = ReadConfig()
 	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("Invalid config.yaml.", err)
+			return
+		}
 		config = DeConfig
 	}
+	// info <url>: 只列出可用音质，不启动 frida
+	if len(os.Args) > 2 && os.Args[1] == "info" {
+		err = InitGin()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		info, err := getQualities(os.Args[2], "")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		out, _ := json.MarshalIndent(info, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
 	go func() {
-		err = config.InitFrida()
+		err := config.InitFrida()
 		if err != nil {
 			panic(err)
-			return
 		}
 	}()
 	err = InitGin()
@@ -1835,38 +4728,110 @@ func main() {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "url not provided"})
 			return
 		}
-		storefront, albumId := checkUrl(url)
-		if albumId == "" {
+		task := Task{Url: url}
+		task.Storefront, task.AlbumId, task.SongId = checkUrl(url)
+		if task.AlbumId == "" && task.SongId == "" {
+			task.Storefront, task.PlaylistId = checkPlaylistUrl(url)
+		}
+		if task.AlbumId == "" && task.SongId == "" && task.PlaylistId == "" {
+			task.AlbumId, task.PlaylistId = checkLibraryUrl(url)
+		}
+		if task.AlbumId == "" && task.SongId == "" && task.PlaylistId == "" {
+			task.Storefront, task.ArtistId = checkArtistUrl(url)
+			if task.ArtistId != "" {
+				filter, err := parseArtistFilter(c.Query, config.Artist)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				task.Artist = &filter
+			}
+		}
+		if task.AlbumId == "" && task.SongId == "" && task.PlaylistId == "" && task.ArtistId == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid url"})
 			return
 		}
-		taskQueue <- []string{url, albumId, storefront}
+		if c.Query("max_bit_depth") != "" || c.Query("max_sample_rate") != "" || c.Query("prefer_exact") != "" || c.Query("fallback") != "" || c.Query("codecs") != "" {
+			quality, err := parseQuality(c.Query, config.Quality)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			task.Quality = &quality
+		}
+		task.Language = c.Query("l")
+		if dir := c.Query("dir"); dir != "" {
+			var err error
+			task.Dir, err = checkDir(dir)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		taskQueue <- task
 		c.JSON(http.StatusOK, gin.H{"message": "download added"})
 		return
 	})
+	applemusic.GET("/info", func(c *gin.Context) {
+		url := c.Query("url")
+		if url == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "url not provided"})
+			return
+		}
+		info, err := getQualities(url, c.Query("l"))
+		if err != nil {
+			// 链接错误返回 400，其余是上游接口、token 或网络的问题
+			status := http.StatusBadGateway
+			switch {
+			case errors.Is(err, ErrInvalidUrl):
+				status = http.StatusBadRequest
+			case errors.Is(err, ErrNotFound):
+				status = http.StatusNotFound
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, info)
+	})
 	applemusic.GET("/status", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"message": "status", "taskQueue": len(taskQueue), "failQueue": len(failQueue), "succQueue": len(succQueue)})
+		c.JSON(http.StatusOK, gin.H{
+			"message":     "status",
+			"taskQueue":   len(taskQueue),
+			"failQueue":   len(failQueue),
+			"succQueue":   len(succQueue),
+			"failDropped": atomic.LoadInt64(&failDropped),
+			"succDropped": atomic.LoadInt64(&succDropped),
+		})
 		return
 	})
 	applemusic.GET("/fail", func(c *gin.Context) {
-		var failList []string
-		for i := 0; i < len(failQueue); i++ {
-			failList = append(failList, <-failQueue...)
+		var failList []Task
+		for len(failQueue) > 0 {
+			failList = append(failList, <-failQueue)
 		}
 		c.JSON(http.StatusOK, gin.H{"failList": failList})
 		return
 
 	})
+	// 返回已完成的任务，包含从备用地区下载的曲目 trackStorefronts
+	applemusic.GET("/succ", func(c *gin.Context) {
+		var succList []Task
+		for len(succQueue) > 0 {
+			succList = append(succList, <-succQueue)
+		}
+		c.JSON(http.StatusOK, gin.H{"succList": succList})
+		return
+	})
 	go func() {
 		for {
 			select {
 			case task := <-taskQueue:
-				err := Download(task[1], task[2])
+				err := Download(&task)
 				if err != nil {
-					task = append(task, err.Error())
-					failQueue <- task
+					task.Error = err.Error()
+					pushTask(failQueue, &failDropped, task)
 				} else {
-					succQueue <- task
+					pushTask(succQueue, &succDropped, task)
 				}
 			}
 		}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		sanitize  string
+		name      string
+		maxLength int
+		want      string
+	}{
+		{"windows", `AC/DC: Back in Black?`, 0, "AC_DC_ Back in Black_"},
+		{"windows", "Trailing dots...", 0, "Trailing dots"},
+		{"windows", "con", 0, "_con"},
+		{"windows", "..", 0, "_"},
+		{"windows", "", 0, "_"},
+		{"macos", `AC/DC: "Live"`, 0, `AC_DC_ "Live"`},
+		{"linux", "a/b:c", 0, "a_b:c"},
+		{"linux", ".", 0, "_"},
+		{"linux", "abcdef", 3, "abc"},
+		{"linux", "日本語", 4, "日"},
+	}
+	for _, tt := range tests {
+		config.Sanitize = tt.sanitize
+		if got := sanitizeName(tt.name, tt.maxLength); got != tt.want {
+			t.Errorf("sanitizeName(%q, %d) with %s = %q, want %q", tt.name, tt.maxLength, tt.sanitize, got, tt.want)
+		}
+	}
+}
+
+func TestFormatName(t *testing.T) {
+	config.Sanitize = "windows"
+	config.MaxNameLength = 200
+	fields := map[string]string{
+		"albumArtist": "AC/DC",
+		"album":       "Back in Black",
+		"year":        "1980",
+		"disc":        "1",
+		"track":       "3",
+		"title":       "..",
+	}
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"{albumArtist} - {album}", "AC_DC - Back in Black"},
+		{"{track:2}. {title}", "03"},
+		{"{title}", "_"},
+		{"{year}/{album}", filepath.Join("1980", "Back in Black")},
+		{"{albumArtist}//{album}", filepath.Join("AC_DC", "_", "Back in Black")},
+		{"{codec} {track}", "{codec} 3"},
+	}
+	for _, tt := range tests {
+		if got := formatName(tt.template, fields, 0); got != tt.want {
+			t.Errorf("formatName(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		ok       bool
+	}{
+		{"{albumArtist} - {album}", true},
+		{"{disc}-{track:2}. {title} [{bitDepth}-{sampleRate}]", true},
+		{"{Album}", false},
+		{"{yr} - {album}", false},
+	}
+	for _, tt := range tests {
+		if err := checkTemplate(tt.template); (err == nil) != tt.ok {
+			t.Errorf("checkTemplate(%q) = %v, want ok %v", tt.template, err, tt.ok)
+		}
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{
+		"Album [24-96000]/01. Song.m4a",
+		"Album [16-44100]/01. Song.m4a",
+		"Album [16-44100]/02. Other.m4a",
+		"Other [24-48000]/01. Song.m4a",
+	} {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		os.WriteFile(path, nil, 0644)
+	}
+	os.MkdirAll(filepath.Join(root, "Album [24-192000]", "03. Dir.m4a"), os.ModePerm)
+	tests := []struct {
+		pattern string
+		want    string
+		ok      bool
+	}{
+		{"Album [" + namePlaceholder + "]/01. Song.m4a", "Album [16-44100]/01. Song.m4a", true},
+		{"Album [" + namePlaceholder + "]/02. Other.m4a", "Album [16-44100]/02. Other.m4a", true},
+		{"Album [24-96000]/01. Song.m4a", "Album [24-96000]/01. Song.m4a", true},
+		{namePlaceholder + " [24-48000]/01. Song.m4a", "Other [24-48000]/01. Song.m4a", true},
+		{"Album [" + namePlaceholder + "]/03. Dir.m4a", "", false},
+		{"Album.* [" + namePlaceholder + "]/01. Song.m4a", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := matchPath(root, filepath.Join(root, filepath.FromSlash(tt.pattern)))
+		want := ""
+		if tt.want != "" {
+			want = filepath.Join(root, filepath.FromSlash(tt.want))
+		}
+		if got != want || ok != tt.ok {
+			t.Errorf("matchPath(%q) = %q, %v, want %q, %v", tt.pattern, got, ok, want, tt.ok)
+		}
+	}
+}
+
+func TestParseTtmlTime(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"12.345", 12345 * time.Millisecond, true},
+		{"12.345s", 12345 * time.Millisecond, true},
+		{"1:02.5", 62500 * time.Millisecond, true},
+		{"1:02:03", time.Hour + 2*time.Minute + 3*time.Second, true},
+		{"abc", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseTtmlTime(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseTtmlTime(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestCheckUrl(t *testing.T) {
+	tests := []struct {
+		url                         string
+		storefront, albumId, songId string
+	}{
+		{"https://music.apple.com/us/album/whenever-you-need-somebody-2022-remaster/1624945511", "us", "1624945511", ""},
+		{"https://music.apple.com/us/album/whenever-you-need-somebody-2022-remaster/1624945511?i=1624945512", "us", "1624945511", "1624945512"},
+		{"https://music.apple.com/jp/song/never-gonna-give-you-up/1624945512", "jp", "", "1624945512"},
+		{"https://music.apple.com/us/playlist/todays-hits/pl.f4d106fed2bd41149aaacabb233eb5eb", "", "", ""},
+		{"https://example.com/us/album/x/1624945511", "", "", ""},
+	}
+	for _, tt := range tests {
+		storefront, albumId, songId := checkUrl(tt.url)
+		if storefront != tt.storefront || albumId != tt.albumId || songId != tt.songId {
+			t.Errorf("checkUrl(%q) = %q, %q, %q, want %q, %q, %q", tt.url, storefront, albumId, songId, tt.storefront, tt.albumId, tt.songId)
+		}
+	}
+}